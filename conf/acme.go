@@ -0,0 +1,23 @@
+package conf
+
+const (
+	defaultACMEDirectoryURL = "https://acme-v02.api.letsencrypt.org/directory"
+)
+
+// ACME struct configures the certificates for frontends with autocert
+type ACME struct {
+	// CacheDir stores the account key and certificates across restarts
+	CacheDir     string `yaml:"cache_dir" json:"cacheDir"`
+	DirectoryURL string `yaml:"directory_url" json:"directoryURL"`
+	Email        string `yaml:"email" json:"email"`
+	// CA is a PEM file to trust for the directory, for test servers like pebble
+	CA string `yaml:"ca" json:"ca"`
+}
+
+// SetDefaultsAndValidate sets defaults and validates
+func (a *ACME) SetDefaultsAndValidate() error {
+	if a.DirectoryURL == "" {
+		a.DirectoryURL = defaultACMEDirectoryURL
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package conf
+
+import (
+	"errors"
+)
+
+// Admin struct configures the admin HTTP API
+type Admin struct {
+	// ListenAddr is a TCP address, it needs a token
+	ListenAddr string `yaml:"listen_addr" json:"listenAddr"`
+	// Socket is a Unix socket path, access is limited by its permissions
+	// and the token if one is set
+	Socket string `yaml:"socket" json:"socket"`
+	// Token must be sent as "Authorization: Bearer <token>"
+	Token string `yaml:"token" json:"token"`
+}
+
+// SetDefaultsAndValidate sets defaults and validates
+func (a *Admin) SetDefaultsAndValidate() error {
+	if (a.ListenAddr == "") == (a.Socket == "") {
+		return errors.New("admin: Must specify one of listen_addr or socket")
+	}
+	if a.ListenAddr != "" && a.Token == "" {
+		return errors.New("admin: Must specify a token with listen_addr")
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package conf
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+)
+
+const (
+	defaultClientIPv4Prefix = 32
+	defaultClientIPv6Prefix = 64
+)
+
+// ClientLimits struct limits the connections of each client address of a
+// binding, before its connections are routed
+type ClientLimits struct {
+	// Rate is the new connections per second a client may open, with bursts
+	// of up to Burst. 0 is unlimited.
+	Rate  float64 `yaml:"rate" json:"rate"`
+	Burst int     `yaml:"burst" json:"burst"`
+	// MaxConnections caps a client's concurrent connections, 0 is unlimited
+	MaxConnections int `yaml:"max_connections" json:"maxConnections"`
+	// clients are the addresses in the same network of these prefix
+	// lengths, 32 and 64 by default
+	IPv4Prefix int `yaml:"ipv4_prefix" json:"ipv4Prefix"`
+	IPv6Prefix int `yaml:"ipv6_prefix" json:"ipv6Prefix"`
+	// Allow is the IPs and CIDRs that aren't limited
+	Allow []string `yaml:"allow" json:"allow"`
+}
+
+// SetDefaultsAndValidate sets defaults and validates
+func (c *ClientLimits) SetDefaultsAndValidate() error {
+	if c.Rate < 0 || c.Burst < 0 || c.MaxConnections < 0 {
+		return errors.New("Client limits rate, burst and max_connections can't be negative")
+	}
+	if c.Rate == 0 && c.MaxConnections == 0 {
+		return errors.New("Client limits need a rate or max_connections")
+	}
+	if c.Rate == 0 && c.Burst > 0 {
+		return errors.New("Client limits burst needs a rate")
+	}
+	if c.Rate > 0 && c.Burst == 0 {
+		c.Burst = int(math.Max(1, math.Ceil(c.Rate)))
+	}
+
+	if c.IPv4Prefix == 0 {
+		c.IPv4Prefix = defaultClientIPv4Prefix
+	}
+	if c.IPv6Prefix == 0 {
+		c.IPv6Prefix = defaultClientIPv6Prefix
+	}
+	if c.IPv4Prefix < 0 || c.IPv4Prefix > 32 || c.IPv6Prefix < 0 || c.IPv6Prefix > 128 {
+		return errors.New("Client limits ipv4_prefix must be up to 32 and ipv6_prefix up to 128")
+	}
+
+	if _, err := ParseCIDRs(c.Allow); err != nil {
+		return fmt.Errorf("Client limits allow: %v", err)
+	}
+	return nil
+}
+
+// ParseCIDRs parses a list of CIDRs, a plain IP is the network of just
+// that address
+func ParseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		s = strings.TrimSpace(s)
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid IP '%v'", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CIDR '%v'", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
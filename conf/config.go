@@ -1,57 +1,235 @@
 package conf
 
 import (
+	"encoding/json"
 	"fmt"
 )
 
+const (
+	defaultDrainTimeout   = 30000 // milliseconds
+	defaultSessionTimeout = 30000 // milliseconds
+)
+
+// Binding modes, bindings mux TLS or HTTP connections by name by default
+const (
+	// ModeTCP forwards every connection to the binding's frontend
+	ModeTCP = "tcp"
+	// ModeUDP forwards datagrams to the binding's frontend, with a session
+	// per client address
+	ModeUDP = "udp"
+)
+
 // NewConfiguration returns a new Configuration
-func NewConfiguration() Configuration {
-	return make(Configuration)
+func NewConfiguration() *Configuration {
+	return &Configuration{
+		Bindings: make(map[string]*Binding),
+	}
+}
+
+// Configuration struct has the bindings by address and the settings for
+// the whole process, which use reserved top level keys
+type Configuration struct {
+	// Metrics serves Prometheus metrics, optional
+	Metrics *Metrics `yaml:"metrics" json:"metrics"`
+	// Admin serves the admin API, optional
+	Admin *Admin `yaml:"admin" json:"admin"`
+	// DrainTimeout is how long proxied connections have to finish when
+	// stopping, in milliseconds
+	DrainTimeout int `yaml:"drain_timeout" json:"drainTimeout"`
+
+	Bindings map[string]*Binding `yaml:",inline" json:"-"`
 }
 
-// Configuration map
-type Configuration map[string]*Binding
+// globalKeys are the top level JSON keys that aren't bindings
+var globalKeys = []string{"metrics", "admin", "drainTimeout"}
+
+type globalConfiguration Configuration
+
+// UnmarshalJSON reads the bindings from the keys that aren't global
+func (c *Configuration) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, (*globalConfiguration)(c)); err != nil {
+		return err
+	}
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	for _, key := range globalKeys {
+		delete(raw, key)
+	}
+	if c.Bindings == nil {
+		c.Bindings = make(map[string]*Binding)
+	}
+	for key, val := range raw {
+		binding := &Binding{}
+		if err := json.Unmarshal(val, binding); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		c.Bindings[key] = binding
+	}
+	return nil
+}
 
 // Binding struct
 type Binding struct {
-	BindAddr  string               `yaml:"bind_addr" json:"bindAddr"`
-	Watch     bool                 `yaml:"watch" json:"watch"`
-	Secure    bool                 `yaml:"secure" json:"secure"`
+	BindAddr string `yaml:"bind_addr" json:"bindAddr"`
+	Watch    bool   `yaml:"watch" json:"watch"`
+	Secure   bool   `yaml:"secure" json:"secure"`
+	// ProxyProtocol expects a PROXY protocol header on every connection
+	ProxyProtocol bool `yaml:"proxy_protocol" json:"proxyProtocol"`
+	// ACME configures certificates for frontends with autocert
+	ACME      *ACME                `yaml:"acme" json:"acme"`
 	Frontends map[string]*Frontend `yaml:"frontends" json:"frontends"`
 
-	// DefaultFrontend *Frontend `yaml:"-" json:"-"`
+	// Mode is empty, tcp or udp
+	Mode string `yaml:"mode" json:"mode"`
+	// Frontend is the only frontend of a tcp or udp binding, it's added to
+	// Frontends under the bind address
+	Frontend *Frontend `yaml:"frontend" json:"frontend"`
+	// SessionTimeout is how long a udp session lasts without datagrams
+	// either way, in milliseconds
+	SessionTimeout int `yaml:"session_timeout" json:"sessionTimeout"`
+
+	// MaxConnections caps the concurrent connections of all the binding's
+	// frontends, with a queue like a frontend's
+	MaxConnections int `yaml:"max_connections" json:"maxConnections"`
+	QueueSize      int `yaml:"queue_size" json:"queueSize"`
+	QueueTimeout   int `yaml:"queue_timeout" json:"queueTimeout"`
+
+	// ClientLimits rate limits and caps the connections of each client
+	// address, optional
+	ClientLimits *ClientLimits `yaml:"client_limits" json:"clientLimits"`
+
+	// Allow and Deny are the IPs and CIDRs of clients the binding accepts
+	// connections from, see Frontend
+	Allow []string `yaml:"allow" json:"allow"`
+	Deny  []string `yaml:"deny" json:"deny"`
+}
+
+// SingleFrontend returns whether the binding sends everything to its one
+// frontend instead of muxing by name
+func (b *Binding) SingleFrontend() bool {
+	return b.Mode == ModeTCP || b.Mode == ModeUDP
 }
 
 // ParseYaml func
-func (c Configuration) ParseYaml(b []byte) error {
+func (c *Configuration) ParseYaml(b []byte) error {
 	return parseYaml(b, c)
 }
 
 // ParseJSON func
-func (c Configuration) ParseJSON(b []byte) error {
+func (c *Configuration) ParseJSON(b []byte) error {
 	return parseJSON(b, c)
 }
 
 // ParseFile func
-func (c Configuration) ParseFile(confPath string) error {
+func (c *Configuration) ParseFile(confPath string) error {
 	return parseFile(confPath, c)
 }
 
 // SetDefaultsAndValidate sets defaults and validates
-func (c Configuration) SetDefaultsAndValidate() error {
-	for key, val := range c {
+func (c *Configuration) SetDefaultsAndValidate() error {
+	if c.DrainTimeout == 0 {
+		c.DrainTimeout = defaultDrainTimeout
+	} else if c.DrainTimeout < 0 {
+		return fmt.Errorf("drain_timeout can't be negative")
+	}
+
+	if c.Metrics != nil {
+		if err := c.Metrics.SetDefaultsAndValidate(); err != nil {
+			return err
+		}
+	}
+	if c.Admin != nil {
+		if err := c.Admin.SetDefaultsAndValidate(); err != nil {
+			return err
+		}
+	}
+
+	for key, val := range c.Bindings {
 		val.BindAddr = key
 
+		switch val.Mode {
+		case "":
+			if val.Frontend != nil {
+				return fmt.Errorf("%s: frontend is only for tcp bindings, use frontends", key)
+			}
+		case ModeTCP, ModeUDP:
+			if val.Frontend == nil {
+				return fmt.Errorf("%s: Must specify a frontend for a %s binding", key, val.Mode)
+			}
+			if val.Secure || val.Watch || val.ACME != nil || len(val.Frontends) > 0 {
+				return fmt.Errorf("%s: Can't use secure, watch, acme or frontends with a %s binding", key, val.Mode)
+			}
+			if val.Frontend.Autocert {
+				return fmt.Errorf("%s: Can't use autocert with a %s binding", key, val.Mode)
+			}
+			val.Frontends = map[string]*Frontend{key: val.Frontend}
+		default:
+			return fmt.Errorf("%s: Unknown mode '%v'", key, val.Mode)
+		}
+
+		if val.Mode == ModeUDP {
+			if val.SessionTimeout == 0 {
+				val.SessionTimeout = defaultSessionTimeout
+			} else if val.SessionTimeout < 0 {
+				return fmt.Errorf("%s: session_timeout can't be negative", key)
+			}
+			if val.ProxyProtocol {
+				return fmt.Errorf("%s: Can't use proxy_protocol with a udp binding", key)
+			}
+			if val.MaxConnections != 0 || val.ClientLimits != nil {
+				return fmt.Errorf("%s: max_connections and client_limits don't apply to a udp binding", key)
+			}
+		} else if val.SessionTimeout != 0 {
+			return fmt.Errorf("%s: session_timeout is only for udp bindings", key)
+		}
+
 		if !val.Watch && len(val.Frontends) == 0 {
 			return fmt.Errorf("%s: Must specify at least one frontend", key)
 		}
 
+		if err := validateLimit(val.MaxConnections, val.QueueSize, &val.QueueTimeout); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+
+		if val.ClientLimits != nil {
+			if err := val.ClientLimits.SetDefaultsAndValidate(); err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+		}
+
+		if err := validateACL(val.Allow, val.Deny); err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+
+		if val.ACME != nil {
+			if err := val.ACME.SetDefaultsAndValidate(); err != nil {
+				return fmt.Errorf("%s: %v", key, err)
+			}
+		}
+
+		var defaultFrontend string
 		for name, front := range val.Frontends {
 			front.Name = name
 			front.BoundAddr = val.BindAddr
 			if err := front.SetDefaultsAndValidate(); err != nil {
 				return err
 			}
+
+			if val.Mode == ModeUDP {
+				if err := front.ValidateUDP(); err != nil {
+					return err
+				}
+			}
+
+			if front.Default {
+				if defaultFrontend != "" {
+					return fmt.Errorf("%s: Only one frontend may be the default, got '%v' and '%v'", key, defaultFrontend, name)
+				}
+				defaultFrontend = name
+			}
 		}
 	}
 
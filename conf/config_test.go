@@ -37,6 +37,8 @@ func Test_Configuration_ParseYaml(t *testing.T) {
 		BoundAddr: "127.0.0.1:55111",   // from parent
 		TLSCrt:    "/test1.crt",
 		TLSKey:    "/test1.key",
+		// defaults when terminating TLS
+		HandshakeTimeout: defaultHandshakeTimeout,
 		Backends: []Backend{
 			Backend{
 				Addr:           ":443",
@@ -59,9 +61,298 @@ func Test_Configuration_ParseYaml(t *testing.T) {
 		f2.Name: f2,
 	}
 
-	expected := Configuration{
-		binding.BindAddr: binding,
+	expected := &Configuration{
+		DrainTimeout: defaultDrainTimeout,
+		Bindings: map[string]*Binding{
+			binding.BindAddr: binding,
+		},
 	}
 
 	assert.EqualValues(t, expected, got)
 }
+
+func Test_Configuration_Metrics(t *testing.T) {
+	input := `
+metrics:
+  listen_addr: 127.0.0.1:9100
+"127.0.0.1:55111":
+  frontends:
+    test1.example.com:
+      backends:
+      - addr: :80
+`
+	got := NewConfiguration()
+	if err := got.ParseYaml([]byte(input)); err != nil {
+		t.Errorf("Error parsing yaml config: %v", err)
+		return
+	}
+	assert.Equal(t, &Metrics{ListenAddr: "127.0.0.1:9100", Path: defaultMetricsPath}, got.Metrics)
+	assert.Len(t, got.Bindings, 1)
+	assert.Contains(t, got.Bindings, "127.0.0.1:55111")
+
+	got = NewConfiguration()
+	input = `{"metrics": {"listenAddr": "127.0.0.1:9100"}, "127.0.0.1:55111": {"frontends": {"test1.example.com": {"backends": [{"addr": ":80"}]}}}}`
+	if err := got.ParseJSON([]byte(input)); err != nil {
+		t.Errorf("Error parsing json config: %v", err)
+		return
+	}
+	assert.Equal(t, "127.0.0.1:9100", got.Metrics.ListenAddr)
+	assert.Len(t, got.Bindings, 1)
+	assert.Contains(t, got.Bindings, "127.0.0.1:55111")
+
+	got = NewConfiguration()
+	if err := got.ParseYaml([]byte("metrics:\n  path: /metrics\n")); err == nil {
+		t.Errorf("Expected error for metrics without listen_addr")
+	}
+}
+
+func Test_Configuration_Admin(t *testing.T) {
+	input := `
+admin:
+  socket: /run/goproxy.sock
+"127.0.0.1:55111":
+  frontends:
+    test1.example.com:
+      backends:
+      - addr: :80
+`
+	got := NewConfiguration()
+	if err := got.ParseYaml([]byte(input)); err != nil {
+		t.Errorf("Error parsing yaml config: %v", err)
+		return
+	}
+	assert.Equal(t, &Admin{Socket: "/run/goproxy.sock"}, got.Admin)
+	assert.Len(t, got.Bindings, 1)
+
+	for _, input := range []string{
+		// a TCP listener needs a token
+		"admin:\n  listen_addr: 127.0.0.1:9000\n",
+		// only one of them
+		"admin:\n  listen_addr: 127.0.0.1:9000\n  socket: /run/goproxy.sock\n  token: secret\n",
+	} {
+		got := NewConfiguration()
+		if err := got.ParseYaml([]byte(input)); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func Test_Configuration_Default(t *testing.T) {
+	input := `
+"127.0.0.1:55111":
+  frontends:
+    test1.example.com:
+      default: true
+      backends:
+      - addr: :80
+    test2.example.com:
+      backends:
+      - addr: :80
+`
+	got := NewConfiguration()
+	if err := got.ParseYaml([]byte(input)); err != nil {
+		t.Errorf("Error parsing yaml config: %v", err)
+		return
+	}
+	assert.True(t, got.Bindings["127.0.0.1:55111"].Frontends["test1.example.com"].Default)
+
+	input = `
+"127.0.0.1:55111":
+  frontends:
+    test1.example.com:
+      default: true
+      backends:
+      - addr: :80
+    test2.example.com:
+      default: true
+      backends:
+      - addr: :80
+`
+	got = NewConfiguration()
+	if err := got.ParseYaml([]byte(input)); err == nil {
+		t.Errorf("Expected error for two default frontends")
+	}
+}
+
+func Test_Configuration_TCP(t *testing.T) {
+	input := `
+":5432":
+  mode: tcp
+  frontend:
+    strategy: least_conn
+    backends:
+    - addr: db1.internal:5432
+    - addr: db2.internal:5432
+`
+	got := NewConfiguration()
+	if err := got.ParseYaml([]byte(input)); err != nil {
+		t.Errorf("Error parsing yaml config: %v", err)
+		return
+	}
+	binding := got.Bindings[":5432"]
+	assert.Equal(t, ModeTCP, binding.Mode)
+	if assert.Len(t, binding.Frontends, 1) {
+		front := binding.Frontends[":5432"]
+		assert.Equal(t, binding.Frontend, front)
+		assert.Equal(t, ":5432", front.Name)
+		assert.Equal(t, StrategyLeastConn, front.Strategy)
+	}
+
+	for _, input := range []string{
+		// no frontend
+		"\":5432\":\n  mode: tcp\n",
+		// frontends need a name to mux on
+		"\":5432\":\n  mode: tcp\n  frontend:\n    backends:\n    - addr: :5433\n  frontends:\n    test1.example.com:\n      backends:\n      - addr: :80\n",
+		// frontend without tcp
+		"\":5432\":\n  frontend:\n    backends:\n    - addr: :5433\n",
+		"\":5432\":\n  mode: sctp\n  frontend:\n    backends:\n    - addr: :5433\n",
+	} {
+		got := NewConfiguration()
+		if err := got.ParseYaml([]byte(input)); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func Test_Configuration_UDP(t *testing.T) {
+	input := `
+":53":
+  mode: udp
+  frontend:
+    backends:
+    - addr: 192.168.0.1:53
+    - addr: 192.168.0.2:53
+`
+	got := NewConfiguration()
+	if err := got.ParseYaml([]byte(input)); err != nil {
+		t.Errorf("Error parsing yaml config: %v", err)
+		return
+	}
+	binding := got.Bindings[":53"]
+	assert.Equal(t, defaultSessionTimeout, binding.SessionTimeout)
+	assert.True(t, binding.SingleFrontend())
+	assert.Len(t, binding.Frontends, 1)
+
+	for _, input := range []string{
+		// TLS needs TCP
+		"\":53\":\n  mode: udp\n  frontend:\n    tls_crt: /test.crt\n    tls_key: /test.key\n    backends:\n    - addr: :5353\n",
+		"\":53\":\n  mode: udp\n  frontend:\n    backends:\n    - addr: :5353\n      tls: true\n",
+		"\":53\":\n  mode: udp\n  frontend:\n    health_check:\n      interval: 1000\n    backends:\n    - addr: :5353\n",
+		"\":53\":\n  mode: udp\n  proxy_protocol: true\n  frontend:\n    backends:\n    - addr: :5353\n",
+		"\":53\":\n  mode: udp\n  frontend:\n    max_connections: 10\n    backends:\n    - addr: :5353\n",
+		// only udp bindings have sessions
+		"\":53\":\n  mode: tcp\n  session_timeout: 1000\n  frontend:\n    backends:\n    - addr: :5353\n",
+	} {
+		got := NewConfiguration()
+		if err := got.ParseYaml([]byte(input)); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func Test_Configuration_MaxConnections(t *testing.T) {
+	input := `
+":443":
+  max_connections: 100
+  queue_size: 10
+  frontends:
+    test1.example.com:
+      backends:
+      - addr: :8080
+`
+	got := NewConfiguration()
+	if err := got.ParseYaml([]byte(input)); err != nil {
+		t.Errorf("Error parsing yaml config: %v", err)
+		return
+	}
+	binding := got.Bindings[":443"]
+	assert.Equal(t, 100, binding.MaxConnections)
+	assert.Equal(t, 10, binding.QueueSize)
+	assert.Equal(t, defaultQueueTimeout, binding.QueueTimeout)
+
+	for _, input := range []string{
+		"\":443\":\n  queue_size: 10\n  frontends:\n    test1.example.com:\n      backends:\n      - addr: :8080\n",
+		"\":53\":\n  mode: udp\n  max_connections: 10\n  frontend:\n    backends:\n    - addr: :5353\n",
+	} {
+		got := NewConfiguration()
+		if err := got.ParseYaml([]byte(input)); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func Test_Configuration_ClientLimits(t *testing.T) {
+	input := `
+":443":
+  client_limits:
+    rate: 2.5
+    max_connections: 20
+    allow:
+    - 10.0.0.0/8
+    - 192.0.2.1
+  frontends:
+    test1.example.com:
+      backends:
+      - addr: :8080
+`
+	got := NewConfiguration()
+	if err := got.ParseYaml([]byte(input)); err != nil {
+		t.Errorf("Error parsing yaml config: %v", err)
+		return
+	}
+	assert.Equal(t, &ClientLimits{
+		Rate:           2.5,
+		Burst:          3,
+		MaxConnections: 20,
+		IPv4Prefix:     defaultClientIPv4Prefix,
+		IPv6Prefix:     defaultClientIPv6Prefix,
+		Allow:          []string{"10.0.0.0/8", "192.0.2.1"},
+	}, got.Bindings[":443"].ClientLimits)
+
+	for _, input := range []string{
+		// nothing to limit
+		"\":443\":\n  client_limits:\n    allow:\n    - 10.0.0.0/8\n  frontends:\n    test1.example.com:\n      backends:\n      - addr: :8080\n",
+		"\":443\":\n  client_limits:\n    rate: 1\n    allow:\n    - 10.0.0.0/33\n  frontends:\n    test1.example.com:\n      backends:\n      - addr: :8080\n",
+		"\":443\":\n  client_limits:\n    rate: 1\n    ipv4_prefix: 40\n  frontends:\n    test1.example.com:\n      backends:\n      - addr: :8080\n",
+	} {
+		got := NewConfiguration()
+		if err := got.ParseYaml([]byte(input)); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func Test_Configuration_ACL(t *testing.T) {
+	input := `
+":443":
+  allow:
+  - 10.0.0.0/8
+  deny:
+  - 10.1.0.0/16
+  frontends:
+    test1.example.com:
+      allow:
+      - 10.2.0.0/16
+      backends:
+      - addr: :8080
+`
+	got := NewConfiguration()
+	if err := got.ParseYaml([]byte(input)); err != nil {
+		t.Errorf("Error parsing yaml config: %v", err)
+		return
+	}
+	binding := got.Bindings[":443"]
+	assert.Equal(t, []string{"10.0.0.0/8"}, binding.Allow)
+	assert.Equal(t, []string{"10.1.0.0/16"}, binding.Deny)
+	assert.Equal(t, []string{"10.2.0.0/16"}, binding.Frontends["test1.example.com"].Allow)
+
+	for _, input := range []string{
+		"\":443\":\n  deny:\n  - example.com\n  frontends:\n    test1.example.com:\n      backends:\n      - addr: :8080\n",
+		"\":443\":\n  allow:\n  - 10.0.0.0/33\n  frontends:\n    test1.example.com:\n      backends:\n      - addr: :8080\n",
+	} {
+		got := NewConfiguration()
+		if err := got.ParseYaml([]byte(input)); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
@@ -1,13 +1,52 @@
 package conf
 
 import (
+	"errors"
 	"fmt"
+	"regexp"
+	"strings"
 
 	"go.uber.org/zap"
 )
 
 const (
 	defaultConnectTimeout = 10000 // milliseconds
+	defaultFailTimeout    = 10000 // milliseconds
+	// for frontends that terminate TLS
+	defaultHandshakeTimeout = 10000 // milliseconds
+	// for connections queued over max_connections
+	defaultQueueTimeout = 10000 // milliseconds
+)
+
+// Backend strategies
+const (
+	StrategyRoundRobin = "round_robin"
+	StrategyLeastConn  = "least_conn"
+	StrategyWeighted   = "weighted_round_robin"
+	// StrategyConsistentHash pins clients to a backend by IP
+	StrategyConsistentHash = "consistent_hash"
+)
+
+// Frontend names that match more than one name
+const (
+	// WildcardPrefix matches names ending with the rest, eg. *.example.com
+	WildcardPrefix = "*."
+	// RegexpPrefix makes the rest a regular expression, eg. ~^api-[0-9]+\.example\.com$
+	RegexpPrefix = "~"
+)
+
+// Client certificate authentication
+const (
+	ClientAuthNone    = "none"
+	ClientAuthRequest = "request"
+	ClientAuthRequire = "require"
+	ClientAuthVerify  = "verify"
+)
+
+// PROXY protocol versions
+const (
+	ProxyProtocolV1 = "v1"
+	ProxyProtocolV2 = "v2"
 )
 
 // NewFrontend returns a new Configuration
@@ -29,13 +68,81 @@ type Frontend struct {
 	Autocert bool      `yaml:"autocert" json:"autocert"`
 	TLSCrt   string    `yaml:"tls_crt" json:"tlsCrt"`
 	TLSKey   string    `yaml:"tls_key" json:"tlsKey"`
-	// Default  bool      `yaml:"default" json:"default"`
+	// ClientCA is a PEM file of CAs that client certificates are verified with
+	ClientCA string `yaml:"client_ca" json:"clientCA"`
+	// ClientAuth is none, request, require or verify, defaults to verify with a client_ca
+	ClientAuth string `yaml:"client_auth" json:"clientAuth"`
+	// HealthCheck is used by backends that don't have their own
+	HealthCheck *HealthCheck `yaml:"health_check" json:"healthCheck"`
+
+	// Retries is the number of other backends to try when dialing a backend fails
+	Retries int `yaml:"retries" json:"retries"`
+	// MaxFails is the number of consecutive dial failures that ejects a backend
+	// for FailTimeout milliseconds, 0 disables ejection
+	MaxFails    int `yaml:"max_fails" json:"maxFails"`
+	FailTimeout int `yaml:"fail_timeout" json:"failTimeout"`
+	// Default gets the connections whose SNI or Host matches no frontend
+	Default bool `yaml:"default" json:"default"`
+
+	// Timeouts of proxied connections in milliseconds, 0 disables them.
+	// IdleTimeout closes connections without data either way for that long,
+	// MaxConnectionDuration closes them however busy they are and
+	// HalfCloseTimeout is how long the other side has to finish once one
+	// side is done.
+	IdleTimeout           int `yaml:"idle_timeout" json:"idleTimeout"`
+	MaxConnectionDuration int `yaml:"max_connection_duration" json:"maxConnectionDuration"`
+	HalfCloseTimeout      int `yaml:"half_close_timeout" json:"halfCloseTimeout"`
+	// HandshakeTimeout is how long clients have to finish the TLS handshake
+	// when it's terminated, 10 seconds by default
+	HandshakeTimeout int `yaml:"handshake_timeout" json:"handshakeTimeout"`
+
+	// MaxConnections caps the frontend's concurrent connections, 0 is
+	// unlimited. Up to QueueSize connections over it wait QueueTimeout
+	// milliseconds for one to finish, the others are rejected.
+	MaxConnections int `yaml:"max_connections" json:"maxConnections"`
+	QueueSize      int `yaml:"queue_size" json:"queueSize"`
+	QueueTimeout   int `yaml:"queue_timeout" json:"queueTimeout"`
+
+	// Allow and Deny are the IPs and CIDRs of clients the frontend accepts
+	// connections from. A client in Deny is denied, otherwise it's allowed
+	// if Allow is empty or has it.
+	Allow []string `yaml:"allow" json:"allow"`
+	Deny  []string `yaml:"deny" json:"deny"`
 }
 
 // Backend struct
 type Backend struct {
 	Addr           string `yaml:"addr" json:"addr"`
 	ConnectTimeout int    `yaml:"connect_timeout" json:"connectTimeout"`
+	// Weight defaults to 1 when unset, 0 drains the backend
+	Weight      *int         `yaml:"weight" json:"weight"`
+	HealthCheck *HealthCheck `yaml:"health_check" json:"healthCheck"`
+	// SendProxyProtocol sends a PROXY protocol header with the client's address
+	SendProxyProtocol string `yaml:"send_proxy_protocol" json:"sendProxyProtocol"`
+
+	// TLS opens a new TLS session to the backend
+	TLS bool `yaml:"tls" json:"tls"`
+	// ServerName defaults to the host of the addr
+	ServerName string `yaml:"server_name" json:"serverName"`
+	// CA is a PEM file of CAs the backend's certificate is verified with,
+	// the system roots are used if empty
+	CA                 string `yaml:"ca" json:"ca"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify" json:"insecureSkipVerify"`
+	// TLSCrt and TLSKey are the client certificate presented to the backend
+	TLSCrt string `yaml:"tls_crt" json:"tlsCrt"`
+	TLSKey string `yaml:"tls_key" json:"tlsKey"`
+
+	// MaxConnections caps the backend's concurrent connections, strategies
+	// skip it when it's full. 0 is unlimited.
+	MaxConnections int `yaml:"max_connections" json:"maxConnections"`
+}
+
+// GetWeight returns the backend's weight
+func (b *Backend) GetWeight() int {
+	if b.Weight == nil {
+		return 1
+	}
+	return *b.Weight
 }
 
 // ParseYaml func
@@ -59,12 +166,72 @@ func (f *Frontend) SetDefaultsAndValidate() error {
 		return fmt.Errorf("%s: Must specify at least one backend for frontend '%v'", f.BoundAddr, f.Name)
 	}
 
-	// if f.Default {
-	// 	if val.DefaultFrontend != nil {
-	// 		return fmt.Errorf("%s: Only one frontend may be the default", f.BoundAddr)
-	// 	}
-	// 	val.DefaultFrontend = f
-	// }
+	if strings.HasPrefix(f.Name, RegexpPrefix) {
+		if _, err := regexp.Compile(strings.TrimPrefix(f.Name, RegexpPrefix)); err != nil {
+			return fmt.Errorf("%s: Invalid regular expression for frontend '%v': %v", f.BoundAddr, f.Name, err)
+		}
+	} else if strings.Contains(strings.TrimPrefix(f.Name, WildcardPrefix), "*") {
+		return fmt.Errorf("%s: A wildcard may only be the first label of frontend '%v'", f.BoundAddr, f.Name)
+	}
+
+	if f.Autocert && (f.TLSCrt != "" || f.TLSKey != "") {
+		return fmt.Errorf("%s: Can't use autocert with tls_crt or tls_key for frontend '%v'", f.BoundAddr, f.Name)
+	}
+	// certificates are requested for the exact name
+	if f.Autocert && (strings.HasPrefix(f.Name, WildcardPrefix) || strings.HasPrefix(f.Name, RegexpPrefix)) {
+		return fmt.Errorf("%s: Can't use autocert with a pattern for frontend '%v'", f.BoundAddr, f.Name)
+	}
+
+	switch f.ClientAuth {
+	case "":
+		if f.ClientCA != "" {
+			f.ClientAuth = ClientAuthVerify
+		}
+	case ClientAuthNone, ClientAuthRequest, ClientAuthRequire:
+	case ClientAuthVerify:
+		if f.ClientCA == "" {
+			return fmt.Errorf("%s: Must specify a client_ca to verify client certificates for frontend '%v'", f.BoundAddr, f.Name)
+		}
+	default:
+		return fmt.Errorf("%s: Unknown client_auth '%v' for frontend '%v'", f.BoundAddr, f.ClientAuth, f.Name)
+	}
+	if f.ClientAuth != "" && f.ClientAuth != ClientAuthNone && f.TLSCrt == "" && f.TLSKey == "" && !f.Autocert {
+		return fmt.Errorf("%s: Client certificates need tls_crt/tls_key or autocert for frontend '%v'", f.BoundAddr, f.Name)
+	}
+
+	switch f.Strategy {
+	case "", StrategyRoundRobin, StrategyLeastConn, StrategyWeighted, StrategyConsistentHash:
+	default:
+		return fmt.Errorf("%s: Unknown strategy '%v' for frontend '%v'", f.BoundAddr, f.Strategy, f.Name)
+	}
+
+	if f.Retries < 0 || f.MaxFails < 0 || f.FailTimeout < 0 {
+		return fmt.Errorf("%s: Retries, max_fails and fail_timeout can't be negative for frontend '%v'", f.BoundAddr, f.Name)
+	}
+	if f.MaxFails > 0 && f.FailTimeout == 0 {
+		f.FailTimeout = defaultFailTimeout
+	}
+
+	if f.IdleTimeout < 0 || f.MaxConnectionDuration < 0 || f.HalfCloseTimeout < 0 || f.HandshakeTimeout < 0 {
+		return fmt.Errorf("%s: idle_timeout, max_connection_duration, half_close_timeout and handshake_timeout can't be negative for frontend '%v'", f.BoundAddr, f.Name)
+	}
+	if f.HandshakeTimeout == 0 && (f.TLSCrt != "" || f.TLSKey != "" || f.Autocert) {
+		f.HandshakeTimeout = defaultHandshakeTimeout
+	}
+
+	if err := validateLimit(f.MaxConnections, f.QueueSize, &f.QueueTimeout); err != nil {
+		return fmt.Errorf("%s: %v for frontend '%v'", f.BoundAddr, err, f.Name)
+	}
+
+	if err := validateACL(f.Allow, f.Deny); err != nil {
+		return fmt.Errorf("%s: %v for frontend '%v'", f.BoundAddr, err, f.Name)
+	}
+
+	if f.HealthCheck != nil {
+		if err := f.HealthCheck.SetDefaultsAndValidate(); err != nil {
+			return fmt.Errorf("%s: %v for frontend '%v'", f.BoundAddr, err, f.Name)
+		}
+	}
 
 	for i := range f.Backends {
 		back := &f.Backends[i]
@@ -77,7 +244,84 @@ func (f *Frontend) SetDefaultsAndValidate() error {
 		if back.Addr == "" {
 			return fmt.Errorf("%s: Must specify an addr for each backend on frontend '%v'", f.BoundAddr, f.Name)
 		}
+		if back.GetWeight() < 0 {
+			return fmt.Errorf("%s: Weight can't be negative for backend '%v' on frontend '%v'", f.BoundAddr, back.Addr, f.Name)
+		}
+		if back.MaxConnections < 0 {
+			return fmt.Errorf("%s: max_connections can't be negative for backend '%v' on frontend '%v'", f.BoundAddr, back.Addr, f.Name)
+		}
+
+		switch back.SendProxyProtocol {
+		case "", ProxyProtocolV1, ProxyProtocolV2:
+		default:
+			return fmt.Errorf("%s: Unknown PROXY protocol version '%v' for backend '%v' on frontend '%v'", f.BoundAddr, back.SendProxyProtocol, back.Addr, f.Name)
+		}
+
+		if !back.TLS && (back.ServerName != "" || back.CA != "" || back.InsecureSkipVerify || back.TLSCrt != "" || back.TLSKey != "") {
+			return fmt.Errorf("%s: TLS options need tls to be set for backend '%v' on frontend '%v'", f.BoundAddr, back.Addr, f.Name)
+		}
+		if (back.TLSCrt == "") != (back.TLSKey == "") {
+			return fmt.Errorf("%s: Must specify both tls_crt and tls_key for backend '%v' on frontend '%v'", f.BoundAddr, back.Addr, f.Name)
+		}
+
+		if back.HealthCheck == nil {
+			back.HealthCheck = f.HealthCheck
+		} else if err := back.HealthCheck.SetDefaultsAndValidate(); err != nil {
+			return fmt.Errorf("%s: %v for backend '%v' on frontend '%v'", f.BoundAddr, err, back.Addr, f.Name)
+		}
+	}
+
+	return nil
+}
+
+// ValidateUDP checks the frontend of a udp binding doesn't use what only
+// works over TCP
+func (f *Frontend) ValidateUDP() error {
+	if f.TLSCrt != "" || f.TLSKey != "" || f.ClientCA != "" || f.Autocert {
+		return fmt.Errorf("%s: Can't terminate TLS for the udp frontend '%v'", f.BoundAddr, f.Name)
+	}
+	if f.IdleTimeout != 0 || f.MaxConnectionDuration != 0 || f.HalfCloseTimeout != 0 {
+		return fmt.Errorf("%s: Connection timeouts don't apply to the udp frontend '%v', use the binding's session_timeout", f.BoundAddr, f.Name)
+	}
+	if f.MaxConnections != 0 {
+		return fmt.Errorf("%s: max_connections doesn't apply to the udp frontend '%v'", f.BoundAddr, f.Name)
+	}
+	for _, back := range f.Backends {
+		if back.MaxConnections != 0 {
+			return fmt.Errorf("%s: max_connections doesn't apply to backend '%v' on the udp frontend '%v'", f.BoundAddr, back.Addr, f.Name)
+		}
+		if back.TLS || back.SendProxyProtocol != "" {
+			return fmt.Errorf("%s: Can't use tls or send_proxy_protocol for backend '%v' on the udp frontend '%v'", f.BoundAddr, back.Addr, f.Name)
+		}
+		if back.HealthCheck != nil {
+			return fmt.Errorf("%s: Health checks connect over TCP, can't use them for backend '%v' on the udp frontend '%v'", f.BoundAddr, back.Addr, f.Name)
+		}
 	}
+	return nil
+}
 
+// validateLimit checks max_connections and its queue, the queue timeout
+// defaults when there's a queue
+func validateLimit(maxConnections, queueSize int, queueTimeout *int) error {
+	if maxConnections < 0 || queueSize < 0 || *queueTimeout < 0 {
+		return errors.New("max_connections, queue_size and queue_timeout can't be negative")
+	}
+	if maxConnections == 0 && queueSize > 0 {
+		return errors.New("queue_size needs max_connections")
+	}
+	if queueSize > 0 && *queueTimeout == 0 {
+		*queueTimeout = defaultQueueTimeout
+	}
+	return nil
+}
+
+// validateACL checks the IPs and CIDRs of allow and deny
+func validateACL(allow, deny []string) error {
+	if _, err := ParseCIDRs(allow); err != nil {
+		return fmt.Errorf("allow: %v", err)
+	}
+	if _, err := ParseCIDRs(deny); err != nil {
+		return fmt.Errorf("deny: %v", err)
+	}
 	return nil
 }
@@ -27,6 +27,8 @@ backends:
 		Name:      "test1.example.com", // from parent map key or filename
 		TLSCrt:    "/test1.crt",
 		TLSKey:    "/test1.key",
+		// defaults when terminating TLS
+		HandshakeTimeout: defaultHandshakeTimeout,
 		Backends: []Backend{
 			Backend{
 				Addr:           ":80",
@@ -41,3 +43,310 @@ backends:
 
 	assert.EqualValues(t, expected, got)
 }
+
+func Test_Frontend_Strategy(t *testing.T) {
+	input := `
+strategy: least_conn
+backends:
+- addr: :80
+`
+	got := NewFrontend("127.0.0.1:55111", "test1.example.com", nil)
+	if err := got.ParseYaml([]byte(input)); err != nil {
+		t.Errorf("Error parsing yaml config: %v", err)
+		return
+	}
+	assert.Equal(t, StrategyLeastConn, got.Strategy)
+
+	input = `
+strategy: fastest
+backends:
+- addr: :80
+`
+	got = NewFrontend("127.0.0.1:55111", "test1.example.com", nil)
+	if err := got.ParseYaml([]byte(input)); err == nil {
+		t.Errorf("Expected error for unknown strategy")
+	}
+}
+
+func Test_Frontend_Weight(t *testing.T) {
+	input := `
+strategy: weighted_round_robin
+backends:
+- addr: :80
+  weight: 3
+- addr: :8080
+  weight: 0
+- addr: :8081
+`
+	got := NewFrontend("127.0.0.1:55111", "test1.example.com", nil)
+	if err := got.ParseYaml([]byte(input)); err != nil {
+		t.Errorf("Error parsing yaml config: %v", err)
+		return
+	}
+	assert.Equal(t, 3, got.Backends[0].GetWeight())
+	assert.Equal(t, 0, got.Backends[1].GetWeight())
+	assert.Equal(t, 1, got.Backends[2].GetWeight())
+
+	input = `
+backends:
+- addr: :80
+  weight: -1
+`
+	got = NewFrontend("127.0.0.1:55111", "test1.example.com", nil)
+	if err := got.ParseYaml([]byte(input)); err == nil {
+		t.Errorf("Expected error for negative weight")
+	}
+}
+
+func Test_Frontend_HealthCheck(t *testing.T) {
+	input := `
+health_check:
+  interval: 1000
+  http_path: /health
+backends:
+- addr: :80
+- addr: :8080
+  health_check:
+    tls: true
+`
+	got := NewFrontend("127.0.0.1:55111", "test1.example.com", nil)
+	if err := got.ParseYaml([]byte(input)); err != nil {
+		t.Errorf("Error parsing yaml config: %v", err)
+		return
+	}
+
+	frontCheck := &HealthCheck{
+		Interval: 1000,
+		Timeout:  defaultHealthCheckTimeout,
+		Rise:     defaultHealthCheckRise,
+		Fall:     defaultHealthCheckFall,
+		HTTPPath: "/health",
+	}
+	assert.EqualValues(t, frontCheck, got.HealthCheck)
+	// inherited from the frontend
+	assert.EqualValues(t, frontCheck, got.Backends[0].HealthCheck)
+	assert.EqualValues(t, &HealthCheck{
+		Interval: defaultHealthCheckInterval,
+		Timeout:  defaultHealthCheckTimeout,
+		Rise:     defaultHealthCheckRise,
+		Fall:     defaultHealthCheckFall,
+		TLS:      true,
+	}, got.Backends[1].HealthCheck)
+}
+
+func Test_Frontend_Retries(t *testing.T) {
+	input := `
+retries: 2
+max_fails: 3
+backends:
+- addr: :80
+`
+	got := NewFrontend("127.0.0.1:55111", "test1.example.com", nil)
+	if err := got.ParseYaml([]byte(input)); err != nil {
+		t.Errorf("Error parsing yaml config: %v", err)
+		return
+	}
+	assert.Equal(t, 2, got.Retries)
+	assert.Equal(t, 3, got.MaxFails)
+	assert.Equal(t, defaultFailTimeout, got.FailTimeout)
+}
+
+func Test_Frontend_SendProxyProtocol(t *testing.T) {
+	input := `
+backends:
+- addr: :80
+  send_proxy_protocol: v3
+`
+	got := NewFrontend("127.0.0.1:55111", "test1.example.com", nil)
+	if err := got.ParseYaml([]byte(input)); err == nil {
+		t.Errorf("Expected error for unknown PROXY protocol version")
+	}
+}
+
+func Test_Frontend_BackendTLS(t *testing.T) {
+	input := `
+backends:
+- addr: backend.internal:443
+  tls: true
+  ca: /ca.pem
+`
+	got := NewFrontend("127.0.0.1:55111", "test1.example.com", nil)
+	if err := got.ParseYaml([]byte(input)); err != nil {
+		t.Errorf("Error parsing yaml config: %v", err)
+		return
+	}
+	assert.True(t, got.Backends[0].TLS)
+	assert.Equal(t, "/ca.pem", got.Backends[0].CA)
+
+	for _, input := range []string{
+		// TLS options without tls
+		"backends:\n- addr: :443\n  server_name: backend.internal\n",
+		// a client certificate without its key
+		"backends:\n- addr: :443\n  tls: true\n  tls_crt: /client.crt\n",
+	} {
+		got := NewFrontend("127.0.0.1:55111", "test1.example.com", nil)
+		if err := got.ParseYaml([]byte(input)); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func Test_Frontend_Autocert(t *testing.T) {
+	input := `
+autocert: true
+tls_crt: /test1.crt
+tls_key: /test1.key
+backends:
+- addr: :80
+`
+	got := NewFrontend("127.0.0.1:55111", "test1.example.com", nil)
+	if err := got.ParseYaml([]byte(input)); err == nil {
+		t.Errorf("Expected error for autocert with a certificate")
+	}
+
+	// no certificate can be requested for a pattern
+	for _, name := range []string{"*.example.com", `~^api-[0-9]+\.example\.com$`} {
+		got := NewFrontend("127.0.0.1:55111", name, nil)
+		if err := got.ParseYaml([]byte("autocert: true\nbackends:\n- addr: :80\n")); err == nil {
+			t.Errorf("Expected error for autocert with %v", name)
+		}
+	}
+}
+
+func Test_Frontend_ClientAuth(t *testing.T) {
+	input := `
+tls_crt: /test1.crt
+tls_key: /test1.key
+client_ca: /ca.pem
+backends:
+- addr: :80
+`
+	got := NewFrontend("127.0.0.1:55111", "test1.example.com", nil)
+	if err := got.ParseYaml([]byte(input)); err != nil {
+		t.Errorf("Error parsing yaml config: %v", err)
+		return
+	}
+	assert.Equal(t, ClientAuthVerify, got.ClientAuth)
+
+	for _, input := range []string{
+		// verify needs a CA
+		"tls_crt: /test1.crt\ntls_key: /test1.key\nclient_auth: verify\nbackends:\n- addr: :80\n",
+		// unknown mode
+		"tls_crt: /test1.crt\ntls_key: /test1.key\nclient_auth: maybe\nbackends:\n- addr: :80\n",
+		// TLS isn't terminated
+		"client_auth: require\nbackends:\n- addr: :80\n",
+	} {
+		got := NewFrontend("127.0.0.1:55111", "test1.example.com", nil)
+		if err := got.ParseYaml([]byte(input)); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func Test_Frontend_PatternNames(t *testing.T) {
+	input := "backends:\n- addr: :80\n"
+	for _, name := range []string{
+		"*.tenants.example.com",
+		`~^api-[0-9]+\.example\.com$`,
+	} {
+		got := NewFrontend("127.0.0.1:55111", name, nil)
+		if err := got.ParseYaml([]byte(input)); err != nil {
+			t.Errorf("Error parsing yaml config for %v: %v", name, err)
+		}
+	}
+
+	for _, name := range []string{
+		"api.*.example.com",
+		"*.*.example.com",
+		"~^api-[0-9+\\.example\\.com$",
+	} {
+		got := NewFrontend("127.0.0.1:55111", name, nil)
+		if err := got.ParseYaml([]byte(input)); err == nil {
+			t.Errorf("Expected error for %v", name)
+		}
+	}
+}
+
+func Test_Frontend_Timeouts(t *testing.T) {
+	input := `
+idle_timeout: 300000
+max_connection_duration: 3600000
+half_close_timeout: 5000
+backends:
+- addr: :80
+`
+	got := NewFrontend("127.0.0.1:55111", "test1.example.com", nil)
+	if err := got.ParseYaml([]byte(input)); err != nil {
+		t.Errorf("Error parsing yaml config: %v", err)
+		return
+	}
+	assert.Equal(t, 300000, got.IdleTimeout)
+	assert.Equal(t, 3600000, got.MaxConnectionDuration)
+	assert.Equal(t, 5000, got.HalfCloseTimeout)
+	// TLS isn't terminated
+	assert.Equal(t, 0, got.HandshakeTimeout)
+
+	got = NewFrontend("127.0.0.1:55111", "test1.example.com", nil)
+	if err := got.ParseYaml([]byte("idle_timeout: -1\nbackends:\n- addr: :80\n")); err == nil {
+		t.Errorf("Expected error for a negative idle_timeout")
+	}
+}
+
+func Test_Frontend_MaxConnections(t *testing.T) {
+	input := `
+max_connections: 100
+queue_size: 10
+backends:
+- addr: :80
+  max_connections: 50
+`
+	got := NewFrontend("127.0.0.1:55111", "test1.example.com", nil)
+	if err := got.ParseYaml([]byte(input)); err != nil {
+		t.Errorf("Error parsing yaml config: %v", err)
+		return
+	}
+	assert.Equal(t, 100, got.MaxConnections)
+	assert.Equal(t, 10, got.QueueSize)
+	assert.Equal(t, defaultQueueTimeout, got.QueueTimeout)
+	assert.Equal(t, 50, got.Backends[0].MaxConnections)
+
+	for _, input := range []string{
+		"queue_size: 10\nbackends:\n- addr: :80\n",
+		"max_connections: -1\nbackends:\n- addr: :80\n",
+		"backends:\n- addr: :80\n  max_connections: -1\n",
+	} {
+		got := NewFrontend("127.0.0.1:55111", "test1.example.com", nil)
+		if err := got.ParseYaml([]byte(input)); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func Test_Frontend_ACL(t *testing.T) {
+	input := `
+allow:
+- 10.0.0.0/8
+- 2001:db8::/32
+deny:
+- 10.1.2.3
+backends:
+- addr: :80
+`
+	got := NewFrontend("127.0.0.1:55111", "test1.example.com", nil)
+	if err := got.ParseYaml([]byte(input)); err != nil {
+		t.Errorf("Error parsing yaml config: %v", err)
+		return
+	}
+	assert.Equal(t, []string{"10.0.0.0/8", "2001:db8::/32"}, got.Allow)
+	assert.Equal(t, []string{"10.1.2.3"}, got.Deny)
+
+	for _, input := range []string{
+		"allow:\n- 10.0.0.0/40\nbackends:\n- addr: :80\n",
+		"deny:\n- example.com\nbackends:\n- addr: :80\n",
+	} {
+		got := NewFrontend("127.0.0.1:55111", "test1.example.com", nil)
+		if err := got.ParseYaml([]byte(input)); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
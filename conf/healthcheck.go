@@ -0,0 +1,54 @@
+package conf
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	defaultHealthCheckInterval = 5000 // milliseconds
+	defaultHealthCheckTimeout  = 2000 // milliseconds
+	defaultHealthCheckRise     = 2
+	defaultHealthCheckFall     = 3
+)
+
+// HealthCheck struct
+type HealthCheck struct {
+	Interval int `yaml:"interval" json:"interval"` // milliseconds
+	Timeout  int `yaml:"timeout" json:"timeout"`   // milliseconds
+	// Rise is the number of consecutive passing checks to mark a backend healthy
+	Rise int `yaml:"rise" json:"rise"`
+	// Fall is the number of consecutive failing checks to mark a backend unhealthy
+	Fall int `yaml:"fall" json:"fall"`
+	// TLS checks that the backend completes a TLS handshake
+	TLS bool `yaml:"tls" json:"tls"`
+	// HTTPPath checks that a GET to the path returns a 2xx or 3xx status
+	HTTPPath string `yaml:"http_path" json:"httpPath"`
+	// Host is the SNI and Host header of checks, the frontend's name by
+	// default or the backend's host if the name is a pattern
+	Host string `yaml:"host" json:"host"`
+}
+
+// SetDefaultsAndValidate sets defaults and validates
+func (h *HealthCheck) SetDefaultsAndValidate() error {
+	if h.Interval == 0 {
+		h.Interval = defaultHealthCheckInterval
+	}
+	if h.Timeout == 0 {
+		h.Timeout = defaultHealthCheckTimeout
+	}
+	if h.Rise == 0 {
+		h.Rise = defaultHealthCheckRise
+	}
+	if h.Fall == 0 {
+		h.Fall = defaultHealthCheckFall
+	}
+
+	if h.Interval < 0 || h.Timeout < 0 || h.Rise < 0 || h.Fall < 0 {
+		return errors.New("Health check interval, timeout, rise and fall can't be negative")
+	}
+	if h.HTTPPath != "" && !strings.HasPrefix(h.HTTPPath, "/") {
+		return errors.New("Health check http_path must start with '/'")
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package conf
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	defaultMetricsPath = "/metrics"
+)
+
+// Metrics struct configures the Prometheus metrics listener
+type Metrics struct {
+	ListenAddr string `yaml:"listen_addr" json:"listenAddr"`
+	Path       string `yaml:"path" json:"path"`
+}
+
+// SetDefaultsAndValidate sets defaults and validates
+func (m *Metrics) SetDefaultsAndValidate() error {
+	if m.ListenAddr == "" {
+		return errors.New("metrics: Must specify listen_addr")
+	}
+	if m.Path == "" {
+		m.Path = defaultMetricsPath
+	}
+	if !strings.HasPrefix(m.Path, "/") {
+		return errors.New("metrics: path must start with '/'")
+	}
+	return nil
+}
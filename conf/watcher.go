@@ -6,6 +6,7 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -21,11 +22,26 @@ type Updater interface {
 	RemoveFrontend(string)
 }
 
+type fileWatch struct {
+	onChange func()
+}
+
 // ConfigWatcher struct
 type ConfigWatcher struct {
 	// dir     string
-	watcher  *fsnotify.Watcher
+	watcher *fsnotify.Watcher
+
+	watchingL sync.Mutex
+	// by absolute directory, see absDir
 	watching map[string]watchingInfo
+	// directories added after starting are read right away
+	started bool
+
+	filesL sync.Mutex
+	// watches by cleaned absolute file path
+	files map[string][]*fileWatch
+	// number of watched files by absolute directory
+	fileDirs map[string]int
 }
 
 // NewConfigWatcher creates new file watcher for config files
@@ -37,27 +53,69 @@ func NewConfigWatcher() (*ConfigWatcher, error) {
 	return &ConfigWatcher{
 		watcher:  watcher,
 		watching: make(map[string]watchingInfo),
+		files:    make(map[string][]*fileWatch),
+		fileDirs: make(map[string]int),
 	}, nil
 }
 
+// absDir returns the cleaned absolute directory that config and file
+// watches are kept by, so the same directory matches however it's named
+func absDir(dir string) (string, error) {
+	return filepath.Abs(dir)
+}
+
 // Add starts watching the named file or directory (non-recursively).
 func (cw *ConfigWatcher) Add(dir string, bindAddr string, updater Updater) error {
-	// ensure directory has trailing foreward slash
-	if !strings.HasSuffix(dir, "/") {
-		dir += "/"
+	dir, err := absDir(dir)
+	if err != nil {
+		return err
 	}
+	cw.watchingL.Lock()
 	if _, ok := cw.watching[dir]; ok {
+		cw.watchingL.Unlock()
 		return errors.New("Already watching dir")
 	}
 	cw.watching[dir] = watchingInfo{
 		BindAddr: bindAddr,
 		Updater:  updater,
 	}
+	started := cw.started
 	zap.L().Debug("Watching",
 		zap.String("dir", dir),
 		zap.Any("watching", cw.watching),
 	)
-	return cw.watcher.Add(dir)
+	cw.watchingL.Unlock()
+
+	if err := cw.watcher.Add(dir); err != nil {
+		return err
+	}
+	if started {
+		cw.updateDir(dir)
+	}
+	return nil
+}
+
+// Remove stops watching the directory, its frontends are left as they are
+func (cw *ConfigWatcher) Remove(dir string) error {
+	dir, err := absDir(dir)
+	if err != nil {
+		return err
+	}
+	cw.watchingL.Lock()
+	if _, ok := cw.watching[dir]; !ok {
+		cw.watchingL.Unlock()
+		return errors.New("Not watching dir")
+	}
+	delete(cw.watching, dir)
+	cw.watchingL.Unlock()
+
+	// keep watching directories of watched files
+	cw.filesL.Lock()
+	defer cw.filesL.Unlock()
+	if cw.fileDirs[dir] > 0 {
+		return nil
+	}
+	return cw.watcher.Remove(dir)
 }
 
 // Start config directory watching
@@ -73,6 +131,9 @@ func (cw *ConfigWatcher) Start() {
 					return
 				}
 				zap.L().Debug("Watcher event", zap.Any("event", event))
+				if cw.notifyFile(event) {
+					continue
+				}
 				if event.Op&fsnotify.Write == fsnotify.Write {
 					time.Sleep(time.Millisecond) // ???? EOF if we don't wait
 					cw.updateFrontend(event.Name, false)
@@ -89,27 +150,38 @@ func (cw *ConfigWatcher) Start() {
 	}()
 }
 func (cw *ConfigWatcher) updateAll() {
+	cw.watchingL.Lock()
+	cw.started = true
+	var dirs []string
 	for dir := range cw.watching {
-		files, err := ioutil.ReadDir(dir)
-		if err != nil {
-			zap.L().Warn("Failed to read files in directory",
-				zap.String("dir", dir),
-				zap.Error(err),
-			)
-			continue
-		}
+		dirs = append(dirs, dir)
+	}
+	cw.watchingL.Unlock()
 
-		for _, f := range files {
-			if f.IsDir() {
-				continue
-			}
-			cw.updateFrontend(path.Join(dir, f.Name()), false)
+	for _, dir := range dirs {
+		cw.updateDir(dir)
+	}
+}
+func (cw *ConfigWatcher) updateDir(dir string) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		zap.L().Warn("Failed to read files in directory",
+			zap.String("dir", dir),
+			zap.Error(err),
+		)
+		return
+	}
+
+	for _, f := range files {
+		if f.IsDir() {
+			continue
 		}
+		cw.updateFrontend(path.Join(dir, f.Name()), false)
 	}
 }
 
 func (cw *ConfigWatcher) updateFrontend(filePath string, delete bool) {
-	dir, file := filepath.Split(filePath)
+	dir, file := filepath.Dir(filePath), filepath.Base(filePath)
 	name := strings.TrimSuffix(file, path.Ext(file))
 	zap.L().Debug("Updating Frontend",
 		zap.String("dir", dir),
@@ -117,11 +189,12 @@ func (cw *ConfigWatcher) updateFrontend(filePath string, delete bool) {
 		zap.String("name", name),
 	)
 
+	cw.watchingL.Lock()
 	info, ok := cw.watching[dir]
+	cw.watchingL.Unlock()
 	if !ok {
 		zap.L().Warn("No watching info found",
 			zap.String("dir", dir),
-			zap.Any("watching", cw.watching),
 		)
 		return
 	}
@@ -150,6 +223,100 @@ func (cw *ConfigWatcher) updateFrontend(filePath string, delete bool) {
 	zap.L().Info("New frontend", zap.Any("frontend", frontend))
 }
 
+// WatchFiles calls onChange whenever one of the files is written, created,
+// replaced or removed, until the returned unwatch function is called.
+// Their directories are watched so files replaced by a rename are noticed.
+func (cw *ConfigWatcher) WatchFiles(onChange func(), files ...string) (func(), error) {
+	cw.filesL.Lock()
+	defer cw.filesL.Unlock()
+
+	fw := &fileWatch{onChange: onChange}
+	var paths []string
+	for _, file := range files {
+		p, err := filepath.Abs(file)
+		if err == nil && cw.fileDirs[filepath.Dir(p)] == 0 {
+			err = cw.watcher.Add(filepath.Dir(p))
+		}
+		if err != nil {
+			cw.unwatchFiles(paths, fw)
+			return nil, err
+		}
+		cw.fileDirs[filepath.Dir(p)]++
+		cw.files[p] = append(cw.files[p], fw)
+		paths = append(paths, p)
+	}
+
+	return func() {
+		cw.filesL.Lock()
+		defer cw.filesL.Unlock()
+		cw.unwatchFiles(paths, fw)
+	}, nil
+}
+
+func (cw *ConfigWatcher) unwatchFiles(paths []string, fw *fileWatch) {
+	for _, p := range paths {
+		cw.unwatchFile(p, fw)
+	}
+}
+
+func (cw *ConfigWatcher) unwatchFile(p string, fw *fileWatch) {
+	watches := cw.files[p]
+	for i, w := range watches {
+		if w == fw {
+			watches = append(watches[:i], watches[i+1:]...)
+			break
+		}
+	}
+	if len(watches) == 0 {
+		delete(cw.files, p)
+	} else {
+		cw.files[p] = watches
+	}
+
+	dir := filepath.Dir(p)
+	cw.fileDirs[dir]--
+	if cw.fileDirs[dir] > 0 {
+		return
+	}
+	delete(cw.fileDirs, dir)
+	// keep watching config directories
+	if !cw.watchingDir(dir) {
+		cw.watcher.Remove(dir)
+	}
+}
+
+// watchingDir returns whether the absolute directory is a config directory
+func (cw *ConfigWatcher) watchingDir(dir string) bool {
+	cw.watchingL.Lock()
+	defer cw.watchingL.Unlock()
+	_, ok := cw.watching[dir]
+	return ok
+}
+
+// notifyFile calls the watches of the event's file and returns whether
+// there were any
+func (cw *ConfigWatcher) notifyFile(event fsnotify.Event) bool {
+	p, err := filepath.Abs(event.Name)
+	if err != nil {
+		return false
+	}
+
+	cw.filesL.Lock()
+	watches := append([]*fileWatch(nil), cw.files[p]...)
+	cw.filesL.Unlock()
+
+	if len(watches) == 0 {
+		return false
+	}
+	if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) != 0 {
+		time.Sleep(time.Millisecond) // ???? EOF if we don't wait
+		for _, w := range watches {
+			w.onChange()
+		}
+	}
+	return true
+}
+
 // Stop config directory watching
 func (cw *ConfigWatcher) Stop() error {
 	return cw.watcher.Close()
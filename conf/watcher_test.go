@@ -0,0 +1,203 @@
+package conf
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_ConfigWatcher_WatchFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy-watcher")
+	if err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	crt := path.Join(dir, "test.crt")
+	ioutil.WriteFile(crt, []byte("old"), 0600)
+
+	cw, err := NewConfigWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer cw.Stop()
+
+	changed := make(chan struct{}, 10)
+	unwatch, err := cw.WatchFiles(func() { changed <- struct{}{} }, crt)
+	if err != nil {
+		t.Fatalf("Failed to watch files: %v", err)
+	}
+	cw.Start()
+
+	// other files in the directory are ignored
+	ioutil.WriteFile(path.Join(dir, "other.crt"), []byte("other"), 0600)
+	select {
+	case <-changed:
+		t.Fatalf("Expected no change for another file")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// replaced by a rename, like most rotation tools do
+	tmp := path.Join(dir, "test.crt.tmp")
+	ioutil.WriteFile(tmp, []byte("new"), 0600)
+	os.Rename(tmp, crt)
+	select {
+	case <-changed:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected a change after replacing the file")
+	}
+
+	unwatch()
+	for len(changed) > 0 {
+		<-changed
+	}
+	ioutil.WriteFile(crt, []byte("newer"), 0600)
+	select {
+	case <-changed:
+		t.Fatalf("Expected no change after unwatching")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+type testUpdater struct {
+	replaced chan *Frontend
+}
+
+func (u *testUpdater) ReplaceFrontend(f *Frontend) error {
+	u.replaced <- f
+	return nil
+}
+func (u *testUpdater) RemoveFrontend(string) {}
+
+func Test_ConfigWatcher_AddAfterStart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy-watcher")
+	if err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(path.Join(dir, "test1.example.com.yml"), []byte("backends:\n- addr: :80\n"), 0600)
+
+	cw, err := NewConfigWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer cw.Stop()
+	cw.Start()
+
+	// the existing files are read when added after starting
+	u := &testUpdater{replaced: make(chan *Frontend, 10)}
+	if err := cw.Add(dir, "127.0.0.1:55111", u); err != nil {
+		t.Fatalf("Failed to add dir: %v", err)
+	}
+	select {
+	case f := <-u.replaced:
+		if f.Name != "test1.example.com" {
+			t.Errorf("Wrong frontend name %v", f.Name)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected the existing frontend to be read")
+	}
+
+	if err := cw.Remove(dir); err != nil {
+		t.Fatalf("Failed to remove dir: %v", err)
+	}
+	ioutil.WriteFile(path.Join(dir, "test2.example.com.yml"), []byte("backends:\n- addr: :80\n"), 0600)
+	select {
+	case f := <-u.replaced:
+		t.Fatalf("Expected no frontend after removing the dir, got %v", f.Name)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func Test_ConfigWatcher_RelativeDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy-watcher")
+	if err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to get working dir: %v", err)
+	}
+	rel, err := filepath.Rel(wd, dir)
+	if err != nil {
+		t.Fatalf("Failed to make a relative dir: %v", err)
+	}
+	crt := path.Join(rel, "test.crt")
+	ioutil.WriteFile(crt, []byte("old"), 0600)
+
+	cw, err := NewConfigWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer cw.Stop()
+	cw.Start()
+
+	u := &testUpdater{replaced: make(chan *Frontend, 10)}
+	if err := cw.Add(rel, "127.0.0.1:55111", u); err != nil {
+		t.Fatalf("Failed to add dir: %v", err)
+	}
+
+	// unwatching a certificate beside the config keeps the config watched
+	unwatch, err := cw.WatchFiles(func() {}, crt)
+	if err != nil {
+		t.Fatalf("Failed to watch files: %v", err)
+	}
+	unwatch()
+
+	ioutil.WriteFile(path.Join(dir, "test1.example.com.yml"), []byte("backends:\n- addr: :80\n"), 0600)
+	select {
+	case f := <-u.replaced:
+		if f.Name != "test1.example.com" {
+			t.Errorf("Wrong frontend name %v", f.Name)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected the config dir to still be watched")
+	}
+
+	if err := cw.Remove(dir); err != nil {
+		t.Errorf("Expected the relative dir to be removed by its absolute name, got %v", err)
+	}
+}
+
+func Test_ConfigWatcher_PatternNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goproxy-watcher")
+	if err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cw, err := NewConfigWatcher()
+	if err != nil {
+		t.Fatalf("Failed to create watcher: %v", err)
+	}
+	defer cw.Stop()
+	cw.Start()
+
+	u := &testUpdater{replaced: make(chan *Frontend, 10)}
+	if err := cw.Add(dir, "127.0.0.1:55111", u); err != nil {
+		t.Fatalf("Failed to add dir: %v", err)
+	}
+
+	for _, name := range []string{
+		"*.tenants.example.com",
+		`~^api-[0-9]+\.example\.com$`,
+	} {
+		ioutil.WriteFile(path.Join(dir, name+".yml"), []byte("backends:\n- addr: :80\n"), 0600)
+		select {
+		case f := <-u.replaced:
+			if f.Name != name {
+				t.Errorf("Wrong frontend name %v, expected %v", f.Name, name)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected a frontend for %v", name)
+		}
+		// drain the events of the same write
+		time.Sleep(100 * time.Millisecond)
+		for len(u.replaced) > 0 {
+			<-u.replaced
+		}
+	}
+}
@@ -5,8 +5,11 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path"
-	"sync"
+	"reflect"
+	"syscall"
+	"time"
 
 	"go.uber.org/zap"
 
@@ -39,61 +42,115 @@ func main() {
 	}
 
 	baseDir := path.Dir(opts.ConfigPath)
-	var cw *conf.ConfigWatcher
-
-	var wg sync.WaitGroup
-	for key, binding := range config {
-		wg.Add(1)
-		// run server
-		s := &proxy.Server{
-			Name:    key,
-			Binding: binding,
-			Logger:  zap.L(),
+	// watches frontend config dirs and certificate files
+	cw, err := conf.NewConfigWatcher()
+	if err != nil {
+		zap.L().Fatal("New configuration watcher", zap.Error(err))
+		os.Exit(1)
+	}
+
+	// listeners passed by systemd or by the process we're upgrading
+	inherited, err := proxy.InheritListeners()
+	if err != nil {
+		zap.L().Fatal("Inherit listeners", zap.Error(err))
+		os.Exit(1)
+	}
+
+	ss := &servers{
+		baseDir:      baseDir,
+		watcher:      cw,
+		inherited:    inherited,
+		drainTimeout: time.Duration(config.DrainTimeout) * time.Millisecond,
+		running:      make(map[string]*proxy.Server),
+		closing:      make(chan struct{}),
+	}
+
+	if config.Metrics != nil {
+		l, err := inherited.Listen("tcp", config.Metrics.ListenAddr)
+		if err != nil {
+			zap.L().Fatal("Failed to listen for metrics", zap.Error(err))
+			os.Exit(1)
 		}
-		s.Init()
-		if binding.Watch {
-			// lazy init config watcher
-			if cw == nil {
-				cw, err = conf.NewConfigWatcher()
-				if err != nil {
-					zap.L().Fatal("New configuration watcher", zap.Error(err))
-					os.Exit(1)
-				}
+		ss.listeners = append(ss.listeners, l)
+		go func() {
+			if err := proxy.ServeMetrics(zap.L(), config.Metrics, l); err != nil && !ss.shuttingDown() {
+				zap.L().Fatal("Failed to serve metrics", zap.Error(err))
+				os.Exit(1)
 			}
+		}()
+	}
 
-			dir := path.Join(baseDir, s.Name)
-			_ = os.MkdirAll(dir, os.ModeDir|os.ModePerm)
-
-			if err := cw.Add(dir, binding.BindAddr, s); err != nil {
-				zap.L().Fatal("Failed to add watch directory",
-					zap.Error(err),
-					zap.String("dir", dir),
-				)
+	if config.Admin != nil {
+		ss.admin = &proxy.Admin{
+			Logger: zap.L(),
+			Admin:  config.Admin,
+		}
+		l, err := ss.admin.Listen(inherited)
+		if err != nil {
+			zap.L().Fatal("Failed to listen for admin API", zap.Error(err))
+			os.Exit(1)
+		}
+		ss.listeners = append(ss.listeners, l)
+		go func() {
+			if err := ss.admin.Serve(l); err != nil && !ss.shuttingDown() {
+				zap.L().Fatal("Failed to serve admin API", zap.Error(err))
 				os.Exit(1)
 			}
+		}()
+	}
+	for key, binding := range config.Bindings {
+		if err := ss.start(key, binding); err != nil {
+			zap.L().Fatal("Failed to start",
+				zap.String("server", key),
+				zap.Error(err),
+			)
+			os.Exit(1)
 		}
+	}
 
-		go func(s *proxy.Server) {
-			go func() {
-				<-s.Ready()
-				wg.Done()
-			}()
-			if err := s.Run(); err != nil {
-				zap.L().Fatal("Failed to start", zap.Error(err))
-				os.Exit(1)
+	// passed listeners that no binding uses anymore
+	inherited.Close()
+
+	zap.L().Info("Start watching")
+	cw.Start()
+
+	// reload on SIGHUP, upgrade on SIGUSR2, stop on SIGTERM or SIGINT
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGUSR2, syscall.SIGTERM, syscall.SIGINT)
+	// the process that started us for an upgrade can stop now
+	notifyParent()
+	for sig := range sigs {
+		switch sig {
+		case syscall.SIGHUP:
+			reload(ss, config, opts.ConfigPath)
+			continue
+		case syscall.SIGUSR2:
+			if err := upgrade(ss); err != nil {
+				zap.L().Error("Failed to upgrade", zap.Error(err))
 			}
-		}(s)
+			continue
+		}
+		zap.L().Info("Shutting down", zap.String("signal", sig.String()))
+		ss.shutdown(upgraded())
+		return
 	}
+}
 
-	wg.Wait()
-	zap.L().Info("Done waiting")
-	if cw != nil {
-		zap.L().Info("Start watching")
-		cw.Start()
+// reload parses the configuration file again and applies it, an invalid
+// one is rejected and the running one kept
+func reload(ss *servers, initial *conf.Configuration, configPath string) {
+	zap.L().Info("Reloading configuration", zap.String("path", configPath))
+	config := conf.NewConfiguration()
+	if err := config.ParseFile(configPath); err != nil {
+		zap.L().Error("Rejected configuration, keeping the running one", zap.Error(err))
+		return
 	}
 
-	// block forever
-	<-make(chan bool)
+	if !reflect.DeepEqual(config.Metrics, initial.Metrics) || !reflect.DeepEqual(config.Admin, initial.Admin) {
+		zap.L().Warn("Changes to metrics and admin need a restart")
+	}
+	ss.reload(config)
+	zap.L().Info("Reloaded configuration")
 }
 
 type Options struct {
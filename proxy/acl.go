@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"net"
+
+	"go.uber.org/zap"
+
+	"github.com/acls/goproxy/conf"
+)
+
+// acl allows or denies client addresses. Deny is checked first, an address
+// in it is denied even if it's also allowed. Otherwise it's allowed if allow
+// is empty or has it. A nil acl allows everything.
+type acl struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// newACL returns nil if both lists are empty
+func newACL(allow, deny []string) (*acl, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	a := &acl{}
+	var err error
+	if a.allow, err = conf.ParseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if a.deny, err = conf.ParseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *acl) allows(addr net.Addr) bool {
+	if a == nil {
+		return true
+	}
+	ip := addrIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range a.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, n := range a.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP returns the IP of a TCP or UDP address, nil for others
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
+
+// aclCheck closes the connections of clients the binding denies
+type aclCheck struct {
+	*zap.Logger
+	acl      *acl
+	bindAddr string
+}
+
+func (ac *aclCheck) check(c net.Conn) (net.Conn, bool) {
+	if ac.acl.allows(c.RemoteAddr()) {
+		return c, true
+	}
+	deniedConnections.WithLabelValues(ac.bindAddr, "").Inc()
+	ac.Info("Denied connection",
+		zap.String("server", ac.bindAddr),
+		zap.String("from", c.RemoteAddr().String()),
+	)
+	c.Close()
+	return nil, false
+}
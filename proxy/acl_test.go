@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestACL(t *testing.T) {
+	a, err := newACL([]string{"10.0.0.0/8", "2001:db8::/32"}, []string{"10.1.0.0/16", "10.2.3.4"})
+	if err != nil {
+		t.Fatalf("Failed to create acl: %v", err)
+	}
+
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"10.0.0.1", true},
+		{"2001:db8::1", true},
+		// deny wins over allow
+		{"10.1.2.3", false},
+		{"10.2.3.4", false},
+		{"10.2.3.5", true},
+		// not in allow
+		{"192.0.2.1", false},
+		{"2001:db9::1", false},
+	}
+	for _, tt := range tests {
+		addr := &net.TCPAddr{IP: net.ParseIP(tt.ip), Port: 1234}
+		if got := a.allows(addr); got != tt.allowed {
+			t.Errorf("Wrong result for %v. Got %v, expected %v", tt.ip, got, tt.allowed)
+		}
+	}
+
+	// only deny, the rest is allowed
+	a, err = newACL(nil, []string{"192.0.2.0/24"})
+	if err != nil {
+		t.Fatalf("Failed to create acl: %v", err)
+	}
+	if a.allows(&net.UDPAddr{IP: net.ParseIP("192.0.2.1")}) {
+		t.Errorf("Expected 192.0.2.1 to be denied")
+	}
+	if !a.allows(&net.UDPAddr{IP: net.ParseIP("198.51.100.1")}) {
+		t.Errorf("Expected 198.51.100.1 to be allowed")
+	}
+
+	// no lists, no acl
+	if a, err := newACL(nil, nil); a != nil || err != nil {
+		t.Errorf("Expected no acl, got %v, %v", a, err)
+	}
+}
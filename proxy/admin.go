@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/acls/goproxy/conf"
+	"go.uber.org/zap"
+)
+
+const (
+	maxAdminBody = 1 << 20
+)
+
+// Admin serves the admin API:
+//
+//	GET    /bindings                            all servers and their frontends
+//	GET    /bindings/{addr}                     one server
+//	GET    /bindings/{addr}/frontends/{name}    one frontend
+//	PUT    /bindings/{addr}/frontends/{name}    add or replace a frontend from its JSON config
+//	DELETE /bindings/{addr}/frontends/{name}    remove a frontend
+type Admin struct {
+	*zap.Logger
+	*conf.Admin
+
+	serversL sync.Mutex
+	servers  map[string]*Server
+}
+
+// AddServer makes the server manageable by its name
+func (a *Admin) AddServer(s *Server) {
+	a.serversL.Lock()
+	defer a.serversL.Unlock()
+
+	if a.servers == nil {
+		a.servers = make(map[string]*Server)
+	}
+	a.servers[s.Name] = s
+}
+
+// RemoveServer removes the named server
+func (a *Admin) RemoveServer(name string) {
+	a.serversL.Lock()
+	defer a.serversL.Unlock()
+
+	delete(a.servers, name)
+}
+
+func (a *Admin) server(name string) (*Server, bool) {
+	a.serversL.Lock()
+	defer a.serversL.Unlock()
+
+	s, ok := a.servers[name]
+	return s, ok
+}
+
+// Listen listens on the socket or listen address, passed listeners are
+// used if there's one for it
+func (a *Admin) Listen(ls *Listeners) (net.Listener, error) {
+	if a.Socket == "" {
+		return ls.Listen("tcp", a.ListenAddr)
+	}
+	if l := ls.Take("unix", a.Socket); l != nil {
+		return l, nil
+	}
+
+	// remove the socket left by a previous run, but nothing else
+	if fi, err := os.Lstat(a.Socket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(a.Socket)
+	}
+	l, err := net.Listen("unix", a.Socket)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(a.Socket, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Serve serves the API on the listener
+func (a *Admin) Serve(l net.Listener) error {
+	a.Info("Serving admin API", zap.String("addr", l.Addr().String()))
+	return newHTTPServer(a).Serve(l)
+}
+
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSONError(w, http.StatusUnauthorized, "Unauthorized")
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] != "bindings" {
+		writeJSONError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		a.listServers(w)
+	case len(parts) == 2 && r.Method == http.MethodGet:
+		if s, ok := a.server(parts[1]); ok {
+			writeJSON(w, http.StatusOK, s.Status())
+		} else {
+			writeJSONError(w, http.StatusNotFound, "Binding not found")
+		}
+	case len(parts) == 4 && parts[2] == "frontends":
+		s, ok := a.server(parts[1])
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "Binding not found")
+			return
+		}
+		a.serveFrontend(w, r, s, parts[3])
+	case len(parts) <= 2:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	default:
+		writeJSONError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+func (a *Admin) authorized(r *http.Request) bool {
+	if a.Token == "" {
+		return true
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) == 1
+}
+
+func (a *Admin) listServers(w http.ResponseWriter) {
+	a.serversL.Lock()
+	servers := make([]*Server, 0, len(a.servers))
+	for _, s := range a.servers {
+		servers = append(servers, s)
+	}
+	a.serversL.Unlock()
+
+	statuses := make([]ServerStatus, len(servers))
+	for i, s := range servers {
+		statuses[i] = s.Status()
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+func (a *Admin) serveFrontend(w http.ResponseWriter, r *http.Request, s *Server, name string) {
+	switch r.Method {
+	case http.MethodGet:
+		if status, ok := s.FrontendStatus(name); ok {
+			writeJSON(w, http.StatusOK, status)
+		} else {
+			writeJSONError(w, http.StatusNotFound, "Frontend not found")
+		}
+	case http.MethodPut:
+		b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxAdminBody))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		front := conf.NewFrontend(s.Status().BindAddr, name, nil)
+		if err := front.ParseJSON(b); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		_, existed := s.FrontendStatus(name)
+		if err := s.ReplaceFrontend(front); err != nil {
+			a.Error("Failed to replace frontend from the admin API",
+				zap.String("server", s.Name),
+				zap.String("name", name),
+				zap.Error(err),
+			)
+			writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		a.Info("Replaced frontend from the admin API",
+			zap.String("server", s.Name),
+			zap.String("name", name),
+		)
+
+		code := http.StatusOK
+		if !existed {
+			code = http.StatusCreated
+		}
+		status, _ := s.FrontendStatus(name)
+		writeJSON(w, code, status)
+	case http.MethodDelete:
+		if _, ok := s.FrontendStatus(name); !ok {
+			writeJSONError(w, http.StatusNotFound, "Frontend not found")
+			return
+		}
+		s.RemoveFrontend(name)
+		a.Info("Removed frontend from the admin API",
+			zap.String("server", s.Name),
+			zap.String("name", name),
+		)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		zap.L().Warn("Failed to write admin response", zap.Error(err))
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/acls/goproxy/conf"
+	"go.uber.org/zap"
+)
+
+func adminRequest(a *Admin, method, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, r)
+	return w
+}
+
+func TestAdmin(t *testing.T) {
+	_, addr := backendOrFail(t)
+
+	s := mkServer(t, &conf.Binding{
+		Secure:    true,
+		BindAddr:  bindAddr,
+		Frontends: map[string]*conf.Frontend{},
+	})
+	s.Name = bindAddr
+
+	go s.Run()
+	// wait for the listener to bind
+	<-s.Ready()
+	defer s.mux.Close()
+
+	a := &Admin{
+		Logger: zap.L(),
+		Admin:  &conf.Admin{ListenAddr: "127.0.0.1:0", Token: "secret"},
+	}
+	a.AddServer(s)
+
+	// the token is required
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/bindings", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected %v without a token, got %v", http.StatusUnauthorized, w.Code)
+	}
+
+	path := "/bindings/" + bindAddr + "/frontends/test.example.com"
+	if w := adminRequest(a, http.MethodPut, path, `{"backends": []}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected %v for an invalid frontend, got %v", http.StatusBadRequest, w.Code)
+	}
+	if w := adminRequest(a, http.MethodPut, path, `{"backends": [{"addr": "`+addr+`"}]}`); w.Code != http.StatusCreated {
+		t.Fatalf("Expected %v adding a frontend, got %v: %s", http.StatusCreated, w.Code, w.Body)
+	}
+	if w := adminRequest(a, http.MethodPut, path, `{"backends": [{"addr": "`+addr+`"}], "strategy": "least_conn"}`); w.Code != http.StatusOK {
+		t.Fatalf("Expected %v replacing a frontend, got %v: %s", http.StatusOK, w.Code, w.Body)
+	}
+
+	w = adminRequest(a, http.MethodGet, "/bindings", "")
+	var statuses []ServerStatus
+	if err := json.NewDecoder(w.Body).Decode(&statuses); err != nil {
+		t.Fatalf("Failed to decode bindings: %v", err)
+	}
+	if len(statuses) != 1 || len(statuses[0].Frontends) != 1 {
+		t.Fatalf("Expected one binding with one frontend, got %+v", statuses)
+	}
+	front := statuses[0].Frontends[0]
+	if front.Name != "test.example.com" || front.Config.Strategy != conf.StrategyLeastConn {
+		t.Errorf("Expected the replaced frontend, got %+v", front)
+	}
+	if len(front.Backends) != 1 || front.Backends[0].Addr != addr || !front.Backends[0].Healthy {
+		t.Errorf("Expected a healthy backend, got %+v", front.Backends)
+	}
+
+	if w := adminRequest(a, http.MethodDelete, path, ""); w.Code != http.StatusNoContent {
+		t.Errorf("Expected %v removing a frontend, got %v", http.StatusNoContent, w.Code)
+	}
+	if w := adminRequest(a, http.MethodGet, path, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected %v for a removed frontend, got %v", http.StatusNotFound, w.Code)
+	}
+	if w := adminRequest(a, http.MethodDelete, path, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected %v removing it again, got %v", http.StatusNotFound, w.Code)
+	}
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/acls/goproxy/conf"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newCertManager returns the ACME certificate manager for the server's
+// frontends with autocert. Certificates are renewed in the background and
+// served by GetCertificate, so renewals don't need a frontend restart.
+func (s *Server) newCertManager() (*autocert.Manager, error) {
+	acmeConf := s.ACME
+	if acmeConf == nil {
+		acmeConf = &conf.ACME{}
+		acmeConf.SetDefaultsAndValidate()
+	}
+
+	client := &acme.Client{DirectoryURL: acmeConf.DirectoryURL}
+	if acmeConf.CA != "" {
+		pem, err := ioutil.ReadFile(acmeConf.CA)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in '%s'", acmeConf.CA)
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{RootCAs: roots},
+			},
+		}
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Email:      acmeConf.Email,
+		Client:     client,
+		HostPolicy: s.autocertPolicy,
+	}
+	if acmeConf.CacheDir != "" {
+		m.Cache = autocert.DirCache(acmeConf.CacheDir)
+	} else {
+		s.Warn("No ACME cache_dir, certificates will be requested again after a restart",
+			zap.String("server", s.Name),
+		)
+	}
+	return m, nil
+}
+
+// autocertPolicy only allows certificates for frontends with autocert.
+// Clients may send the server name in any case.
+func (s *Server) autocertPolicy(ctx context.Context, host string) error {
+	host = strings.ToLower(host)
+
+	s.frontendsL.Lock()
+	defer s.frontendsL.Unlock()
+
+	if f, ok := s.frontends[host]; ok && f.Autocert {
+		return nil
+	}
+	return errors.New("No autocert frontend for " + host)
+}
+
+// autocertTLSConfig answers TLS-ALPN-01 challenges and serves the managed
+// certificates. acme-tls/1 is only offered to clients asking for it, so
+// other clients don't negotiate a protocol the backend may not speak.
+func autocertTLSConfig(m *autocert.Manager) *tls.Config {
+	return &tls.Config{
+		GetCertificate: m.GetCertificate,
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			for _, proto := range hello.SupportedProtos {
+				if proto == acme.ALPNProto {
+					return &tls.Config{
+						GetCertificate: m.GetCertificate,
+						NextProtos:     []string{acme.ALPNProto},
+					}, nil
+				}
+			}
+			return nil, nil
+		},
+	}
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/acls/goproxy/conf"
+	"golang.org/x/crypto/acme"
+)
+
+func TestAutocert(t *testing.T) {
+	_, addr := backendOrFail(t)
+	cacheDir, err := ioutil.TempDir("", "goproxy-autocert")
+	if err != nil {
+		t.Fatalf("Failed to create cache dir: %v", err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	s := mkServer(t, &conf.Binding{
+		Secure:   true,
+		BindAddr: bindAddr,
+		ACME: &conf.ACME{
+			CacheDir:     cacheDir,
+			DirectoryURL: "https://127.0.0.1:14000/dir",
+		},
+		Frontends: map[string]*conf.Frontend{
+			"auto.example.com": &conf.Frontend{
+				BoundAddr: bindAddr,
+				Name:      "auto.example.com",
+				Autocert:  true,
+				Backends:  []conf.Backend{conf.Backend{Addr: addr}},
+			},
+			"passthrough.example.com": &conf.Frontend{
+				BoundAddr: bindAddr,
+				Name:      "passthrough.example.com",
+				Backends:  []conf.Backend{conf.Backend{Addr: addr}},
+			},
+		},
+	})
+
+	go s.Run()
+	// wait for the listener to bind
+	<-s.Ready()
+	defer s.mux.Close()
+
+	if s.certManager == nil {
+		t.Fatalf("Expected a certificate manager")
+	}
+	if s.frontends["auto.example.com"].TLSConfig == nil {
+		t.Errorf("Expected autocert frontend to terminate TLS")
+	}
+
+	// certificates are only requested for autocert frontends
+	ctx := context.Background()
+	for _, host := range []string{"auto.example.com", "Auto.Example.COM"} {
+		if err := s.autocertPolicy(ctx, host); err != nil {
+			t.Errorf("Expected autocert frontend to be allowed for %v, got %v", host, err)
+		}
+	}
+	for _, host := range []string{"passthrough.example.com", "unknown.example.com"} {
+		if err := s.autocertPolicy(ctx, host); err == nil {
+			t.Errorf("Expected %v not to be allowed", host)
+		}
+	}
+
+	// acme-tls/1 is only negotiated with clients asking for it
+	cfg := autocertTLSConfig(s.certManager)
+	got, _ := cfg.GetConfigForClient(&tls.ClientHelloInfo{SupportedProtos: []string{"h2", "http/1.1"}})
+	if got != nil {
+		t.Errorf("Expected no ALPN config for regular clients, got %v", got.NextProtos)
+	}
+	got, _ = cfg.GetConfigForClient(&tls.ClientHelloInfo{SupportedProtos: []string{acme.ALPNProto}})
+	if got == nil || len(got.NextProtos) != 1 || got.NextProtos[0] != acme.ALPNProto {
+		t.Errorf("Expected acme-tls/1 config for TLS-ALPN-01 challenges, got %v", got)
+	}
+}
@@ -1,25 +1,352 @@
 package proxy
 
-import "github.com/acls/goproxy/conf"
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/acls/goproxy/conf"
+)
+
+// backend holds a backend configuration along with its runtime state
+type backend struct {
+	conf.Backend
+	// set for backends with tls
+	tlsConfig *tls.Config
+	unhealthy int32
+
+	// consecutive dial failures
+	fails int32
+	// unix nanoseconds
+	ejectedUntil int64
+	// proxied connections
+	active int32
+}
+
+// available returns whether the backend can take new connections
+func (b *backend) available() bool {
+	return b.GetWeight() > 0 && b.healthy() && !b.ejected() && !b.full()
+}
+
+// full returns whether the backend is at its max connections
+func (b *backend) full() bool {
+	return b.MaxConnections > 0 && int(atomic.LoadInt32(&b.active)) >= b.MaxConnections
+}
+
+// acquire counts a connection to the backend, it returns false if the
+// backend is at its max connections
+func (b *backend) acquire() bool {
+	for {
+		n := atomic.LoadInt32(&b.active)
+		if b.MaxConnections > 0 && int(n) >= b.MaxConnections {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&b.active, n, n+1) {
+			return true
+		}
+	}
+}
+
+// release uncounts a connection counted by acquire
+func (b *backend) release() {
+	atomic.AddInt32(&b.active, -1)
+}
+
+func (b *backend) healthy() bool {
+	return atomic.LoadInt32(&b.unhealthy) == 0
+}
+
+func (b *backend) setHealthy(healthy bool) {
+	if healthy {
+		atomic.StoreInt32(&b.unhealthy, 0)
+	} else {
+		atomic.StoreInt32(&b.unhealthy, 1)
+	}
+}
+
+func (b *backend) ejected() bool {
+	return time.Now().UnixNano() < atomic.LoadInt64(&b.ejectedUntil)
+}
+
+// dialFailed records a failed dial and returns true if the backend was
+// ejected for the cooldown after maxFails consecutive failures
+func (b *backend) dialFailed(maxFails int, cooldown time.Duration) bool {
+	n := atomic.AddInt32(&b.fails, 1)
+	if maxFails <= 0 || int(n) < maxFails {
+		return false
+	}
+	atomic.StoreInt32(&b.fails, 0)
+	atomic.StoreInt64(&b.ejectedUntil, time.Now().Add(cooldown).UnixNano())
+	return true
+}
+
+// dialSucceeded resets the consecutive dial failures
+func (b *backend) dialSucceeded() {
+	atomic.StoreInt32(&b.fails, 0)
+}
+
+// loadTLSConfig loads the TLS config for a backend with tls
+func (b *backend) loadTLSConfig() error {
+	if !b.TLS {
+		return nil
+	}
+
+	cfg := &tls.Config{
+		ServerName:         b.ServerName,
+		InsecureSkipVerify: b.InsecureSkipVerify,
+	}
+	if cfg.ServerName == "" {
+		if host, _, err := net.SplitHostPort(b.Addr); err == nil {
+			cfg.ServerName = host
+		}
+	}
+	if b.CA != "" {
+		pem, err := ioutil.ReadFile(b.CA)
+		if err != nil {
+			return err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("No certificates found in '%s'", b.CA)
+		}
+	}
+	if b.TLSCrt != "" {
+		cert, err := tls.LoadX509KeyPair(b.TLSCrt, b.TLSKey)
+		if err != nil {
+			return err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	b.tlsConfig = cfg
+	return nil
+}
+
+func newBackends(backends []conf.Backend) []*backend {
+	bs := make([]*backend, len(backends))
+	for i := range backends {
+		bs[i] = &backend{Backend: backends[i]}
+	}
+	return bs
+}
+
+// connContext is the connection a backend is being picked for
+type connContext struct {
+	conn net.Conn
+	// the client's address when there's no conn, for udp sessions
+	clientAddr net.Addr
+	// the SNI or Host name the client asked for
+	serverName string
+	// set when the frontend terminated TLS
+	tlsState *tls.ConnectionState
+	// backends that already failed to connect for this connection
+	tried []*backend
+}
+
+// usable returns whether the backend is available and hasn't been tried yet
+func (ctx *connContext) usable(b *backend) bool {
+	if !b.available() {
+		return false
+	}
+	for _, t := range ctx.tried {
+		if t == b {
+			return false
+		}
+	}
+	return true
+}
+
+// clientIP returns the client's IP, without the port
+func (ctx *connContext) clientIP() string {
+	clientAddr := ctx.clientAddr
+	if ctx.conn != nil {
+		clientAddr = ctx.conn.RemoteAddr()
+	}
+	if clientAddr == nil {
+		return ""
+	}
+	addr := clientAddr.String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
 
 // BackendStrategy interface
 type BackendStrategy interface {
-	NextBackend() conf.Backend
+	// NextBackend picks the backend for a new connection, or nil if none are available
+	NextBackend(ctx *connContext) *backend
+}
+
+func newStrategy(name string, backends []*backend) (BackendStrategy, error) {
+	switch name {
+	case "", conf.StrategyRoundRobin:
+		return &RoundRobinStrategy{backends: backends}, nil
+	case conf.StrategyLeastConn:
+		return &LeastConnStrategy{backends: backends}, nil
+	case conf.StrategyWeighted:
+		return &WeightedRoundRobinStrategy{
+			backends: backends,
+			current:  make([]int, len(backends)),
+		}, nil
+	case conf.StrategyConsistentHash:
+		return newConsistentHashStrategy(backends), nil
+	}
+	return nil, fmt.Errorf("Unknown strategy '%s'", name)
 }
 
 // RoundRobinStrategy interface
 type RoundRobinStrategy struct {
-	backends []conf.Backend
+	mu       sync.Mutex
+	backends []*backend
 	idx      int
 }
 
 // NextBackend returns the next backend configuration
-func (s *RoundRobinStrategy) NextBackend() conf.Backend {
+func (s *RoundRobinStrategy) NextBackend(ctx *connContext) *backend {
 	n := len(s.backends)
 
 	if n == 1 {
+		if !ctx.usable(s.backends[0]) {
+			return nil
+		}
 		return s.backends[0]
 	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := 0; i < n; i++ {
+		s.idx = (s.idx + 1) % n
+		if b := s.backends[s.idx]; ctx.usable(b) {
+			return b
+		}
+	}
+	return nil
+}
+
+// LeastConnStrategy picks the backend with the fewest active connections
+type LeastConnStrategy struct {
+	mu       sync.Mutex
+	backends []*backend
+	idx      int
+}
+
+// NextBackend returns the backend with the fewest active connections.
+// Ties are broken round robin so idle backends share the load.
+func (s *LeastConnStrategy) NextBackend(ctx *connContext) *backend {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := len(s.backends)
 	s.idx = (s.idx + 1) % n
-	return s.backends[s.idx]
+
+	var best *backend
+	var bestActive int32
+	for i := 0; i < n; i++ {
+		b := s.backends[(s.idx+i)%n]
+		if !ctx.usable(b) {
+			continue
+		}
+		if active := atomic.LoadInt32(&b.active); best == nil || active < bestActive {
+			best, bestActive = b, active
+		}
+	}
+	return best
+}
+
+// WeightedRoundRobinStrategy spreads connections in proportion to the
+// backend weights using nginx's smooth weighted round robin, so heavier
+// backends aren't picked in bursts.
+type WeightedRoundRobinStrategy struct {
+	mu       sync.Mutex
+	backends []*backend
+	current  []int
+}
+
+// NextBackend returns the next backend configuration
+func (s *WeightedRoundRobinStrategy) NextBackend(ctx *connContext) *backend {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	best, total := -1, 0
+	for i, b := range s.backends {
+		if !ctx.usable(b) {
+			continue
+		}
+		w := b.GetWeight()
+		s.current[i] += w
+		total += w
+		if best < 0 || s.current[i] > s.current[best] {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	s.current[best] -= total
+	return s.backends[best]
+}
+
+// number of points each unit of weight puts on the hash ring
+const hashRingReplicas = 100
+
+type hashRingPoint struct {
+	hash    uint32
+	backend *backend
+}
+
+// ConsistentHashStrategy pins clients to a backend by hashing the client IP
+// onto a consistent hash ring, so adding or removing a backend only remaps
+// the clients of that backend
+type ConsistentHashStrategy struct {
+	ring []hashRingPoint
+}
+
+func newConsistentHashStrategy(backends []*backend) *ConsistentHashStrategy {
+	s := &ConsistentHashStrategy{}
+	for _, b := range backends {
+		// points are keyed by addr so the ring is the same for the same backends
+		for i := 0; i < hashRingReplicas*b.GetWeight(); i++ {
+			s.ring = append(s.ring, hashRingPoint{
+				hash:    hashKey(b.Addr + "#" + strconv.Itoa(i)),
+				backend: b,
+			})
+		}
+	}
+	sort.Slice(s.ring, func(i, j int) bool {
+		return s.ring[i].hash < s.ring[j].hash
+	})
+	return s
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+// NextBackend returns the backend owning the client IP on the ring, walking
+// clockwise past unusable backends
+func (s *ConsistentHashStrategy) NextBackend(ctx *connContext) *backend {
+	n := len(s.ring)
+	if n == 0 {
+		return nil
+	}
+
+	h := hashKey(ctx.clientIP())
+	start := sort.Search(n, func(i int) bool {
+		return s.ring[i].hash >= h
+	})
+	for i := 0; i < n; i++ {
+		if b := s.ring[(start+i)%n].backend; ctx.usable(b) {
+			return b
+		}
+	}
+	return nil
 }
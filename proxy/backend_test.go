@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/acls/goproxy/conf"
+)
+
+func TestLeastConnStrategy(t *testing.T) {
+	s, err := newStrategy(conf.StrategyLeastConn, newBackends([]conf.Backend{
+		conf.Backend{Addr: "a"},
+		conf.Backend{Addr: "b"},
+		conf.Backend{Addr: "c"},
+	}))
+	if err != nil {
+		t.Fatalf("Failed to create strategy: %v", err)
+	}
+
+	// every backend gets one connection before any gets a second
+	picked := make(map[string]*backend)
+	for i := 0; i < 3; i++ {
+		b := s.NextBackend(&connContext{})
+		b.acquire()
+		picked[b.Addr] = b
+	}
+	if len(picked) != 3 {
+		t.Fatalf("Expected connections spread over 3 backends, got %v", len(picked))
+	}
+
+	// freeing a backend makes it the least loaded
+	picked["b"].release()
+	for i := 0; i < 3; i++ {
+		if b := s.NextBackend(&connContext{}); b.Addr != "b" {
+			t.Fatalf("Expected backend b, got %v", b.Addr)
+		}
+	}
+}
+
+func TestWeightedRoundRobinStrategy(t *testing.T) {
+	weight := func(w int) *int { return &w }
+	s, err := newStrategy(conf.StrategyWeighted, newBackends([]conf.Backend{
+		conf.Backend{Addr: "a", Weight: weight(5)},
+		conf.Backend{Addr: "b", Weight: weight(1)},
+		conf.Backend{Addr: "c", Weight: weight(1)},
+		conf.Backend{Addr: "drained", Weight: weight(0)},
+	}))
+	if err != nil {
+		t.Fatalf("Failed to create strategy: %v", err)
+	}
+
+	// smooth weighted round robin interleaves instead of bursting
+	expected := []string{"a", "a", "b", "a", "c", "a", "a"}
+	for round := 0; round < 2; round++ {
+		for i, addr := range expected {
+			if b := s.NextBackend(&connContext{}); b.Addr != addr {
+				t.Fatalf("Round %v pick %v: expected backend %v, got %v", round, i, addr, b.Addr)
+			}
+		}
+	}
+}
+
+func TestDrainedBackends(t *testing.T) {
+	zero := 0
+	for _, name := range []string{conf.StrategyRoundRobin, conf.StrategyLeastConn, conf.StrategyWeighted, conf.StrategyConsistentHash} {
+		s, err := newStrategy(name, newBackends([]conf.Backend{
+			conf.Backend{Addr: "a"},
+			conf.Backend{Addr: "drained", Weight: &zero},
+		}))
+		if err != nil {
+			t.Fatalf("Failed to create strategy: %v", err)
+		}
+		for i := 0; i < 4; i++ {
+			if b := s.NextBackend(&connContext{}); b == nil || b.Addr != "a" {
+				t.Fatalf("%s: expected backend a, got %v", name, b)
+			}
+		}
+
+		s, _ = newStrategy(name, newBackends([]conf.Backend{
+			conf.Backend{Addr: "drained", Weight: &zero},
+		}))
+		if b := s.NextBackend(&connContext{}); b != nil {
+			t.Fatalf("%s: expected no backend, got %v", name, b.Addr)
+		}
+	}
+}
+
+func TestPassiveEjection(t *testing.T) {
+	b := newBackends([]conf.Backend{conf.Backend{Addr: "a"}})[0]
+
+	if b.dialFailed(2, time.Minute) {
+		t.Fatalf("Expected backend not to be ejected after 1 failure")
+	}
+	b.dialSucceeded()
+	if b.dialFailed(2, time.Minute) {
+		t.Fatalf("Expected a success to reset consecutive failures")
+	}
+	if !b.dialFailed(2, time.Minute) {
+		t.Fatalf("Expected backend to be ejected after 2 failures")
+	}
+	if b.available() {
+		t.Fatalf("Expected ejected backend to be unavailable")
+	}
+
+	// cooldown over
+	b.ejectedUntil = time.Now().Add(-time.Second).UnixNano()
+	if !b.available() {
+		t.Fatalf("Expected backend to be available after the cooldown")
+	}
+
+	// disabled
+	if b.dialFailed(0, time.Minute) {
+		t.Fatalf("Expected no ejection when max fails is 0")
+	}
+}
+
+// addrConn is a net.Conn with a remote address
+type addrConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr { return c.remote }
+
+func clientCtx(i int) *connContext {
+	ip := net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))
+	return &connContext{conn: &addrConn{remote: &net.TCPAddr{IP: ip, Port: 1000 + i}}}
+}
+
+func TestConsistentHashStrategy(t *testing.T) {
+	addrs := []conf.Backend{
+		conf.Backend{Addr: "a"},
+		conf.Backend{Addr: "b"},
+		conf.Backend{Addr: "c"},
+	}
+	s, err := newStrategy(conf.StrategyConsistentHash, newBackends(addrs))
+	if err != nil {
+		t.Fatalf("Failed to create strategy: %v", err)
+	}
+
+	const clients = 3000
+	picked := make([]string, clients)
+	counts := make(map[string]int)
+	for i := range picked {
+		picked[i] = s.NextBackend(clientCtx(i)).Addr
+		counts[picked[i]]++
+	}
+	for _, b := range addrs {
+		if counts[b.Addr] < clients/6 {
+			t.Errorf("Expected clients spread over backends, got %v", counts)
+		}
+	}
+
+	// the same client ip gets the same backend, whatever the port
+	ctx := clientCtx(42)
+	ctx.conn.(*addrConn).remote.(*net.TCPAddr).Port = 5555
+	if b := s.NextBackend(ctx); b.Addr != picked[42] {
+		t.Errorf("Expected client to stick to backend %v, got %v", picked[42], b.Addr)
+	}
+
+	// adding a backend only moves clients to the new backend
+	s, _ = newStrategy(conf.StrategyConsistentHash, newBackends(append(addrs, conf.Backend{Addr: "d"})))
+	moved := 0
+	for i := range picked {
+		if b := s.NextBackend(clientCtx(i)); b.Addr != picked[i] {
+			if b.Addr != "d" {
+				t.Fatalf("Client %v moved from %v to %v instead of the new backend", i, picked[i], b.Addr)
+			}
+			moved++
+		}
+	}
+	if moved > clients/2 {
+		t.Errorf("Expected about a quarter of clients to move, %v of %v did", moved, clients)
+	}
+
+	// tried backends are skipped
+	ctx = clientCtx(42)
+	first := s.NextBackend(ctx)
+	ctx.tried = append(ctx.tried, first)
+	if b := s.NextBackend(ctx); b == nil || b == first {
+		t.Errorf("Expected a different backend after %v failed, got %v", first.Addr, b)
+	}
+}
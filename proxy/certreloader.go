@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// FileWatcher watches files for changes
+type FileWatcher interface {
+	WatchFiles(onChange func(), files ...string) (unwatch func(), err error)
+}
+
+// certReloader serves a certificate/key pair that is loaded again whenever
+// the files change. The previous pair keeps being served if the new one
+// fails to load.
+type certReloader struct {
+	*zap.Logger
+	frontend string
+	crtPath  string
+	keyPath  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newCertReloader(log *zap.Logger, frontend, crtPath, keyPath string) (*certReloader, error) {
+	r := &certReloader{
+		Logger:   log,
+		frontend: frontend,
+		crtPath:  crtPath,
+		keyPath:  keyPath,
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) load() error {
+	cfg, err := loadTLSConfig(r.crtPath, r.keyPath)
+	if err != nil {
+		return err
+	}
+	if len(cfg.Certificates) == 0 {
+		return errors.New("No certificate loaded")
+	}
+
+	r.mu.Lock()
+	r.cert = &cfg.Certificates[0]
+	r.mu.Unlock()
+	return nil
+}
+
+// Reload loads the pair again, keeping the previous one on failure
+func (r *certReloader) Reload() {
+	if err := r.load(); err != nil {
+		r.Error("Failed to reload TLS certificate, keeping the previous one",
+			zap.String("frontend", r.frontend),
+			zap.String("crt", r.crtPath),
+			zap.String("key", r.keyPath),
+			zap.Error(err),
+		)
+		return
+	}
+	r.Info("Reloaded TLS certificate",
+		zap.String("frontend", r.frontend),
+		zap.String("crt", r.crtPath),
+	)
+}
+
+// GetCertificate returns the current certificate
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestCertReloader(t *testing.T) {
+	r, err := newCertReloader(zap.L(), "test.example.com", "/snakeoil.crt", "/snakeoil.key")
+	if err != nil {
+		t.Fatalf("Failed to load certificate: %v", err)
+	}
+	first, _ := r.GetCertificate(nil)
+
+	// a new pair is served after a reload
+	r.Reload()
+	second, _ := r.GetCertificate(nil)
+	if second == first {
+		t.Errorf("Expected a new certificate after reloading")
+	}
+
+	// the previous pair is kept if the new one fails to load
+	defer func(load func(string, string) (*tls.Config, error)) {
+		loadTLSConfig = load
+	}(loadTLSConfig)
+	loadTLSConfig = func(crtPath, keyPath string) (*tls.Config, error) {
+		return nil, errors.New("tls: private key does not match public key")
+	}
+	r.Reload()
+	if got, _ := r.GetCertificate(nil); got != second {
+		t.Errorf("Expected the previous certificate after a failed reload")
+	}
+}
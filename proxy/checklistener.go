@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+)
+
+// connCheck returns the connection to hand on, false if it was closed
+type connCheck func(c net.Conn) (net.Conn, bool)
+
+// checkListener runs checks on the connections it accepts, before anything
+// else reads from them. A PROXY protocol connection's client address isn't
+// known until its header is read, so those are checked in a goroutine each
+// and a client that never sends its header doesn't hold up the others.
+type checkListener struct {
+	net.Listener
+	checks []connCheck
+
+	conns     chan net.Conn
+	errs      chan error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newCheckListener(l net.Listener, checks ...connCheck) net.Listener {
+	cl := &checkListener{
+		Listener: l,
+		checks:   checks,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		closed:   make(chan struct{}),
+	}
+	go cl.run()
+	return cl
+}
+
+func (l *checkListener) run() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.closed:
+				return
+			}
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				continue
+			}
+			return
+		}
+		if _, ok := c.(*proxyProtoConn); ok {
+			go l.check(c)
+		} else {
+			l.check(c)
+		}
+	}
+}
+
+func (l *checkListener) check(c net.Conn) {
+	for _, check := range l.checks {
+		var ok bool
+		if c, ok = check(c); !ok {
+			return
+		}
+	}
+	select {
+	case l.conns <- c:
+	case <-l.closed:
+		c.Close()
+	}
+}
+
+func (l *checkListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.closed:
+		return nil, errListenerClosed
+	}
+}
+
+func (l *checkListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return l.Listener.Close()
+}
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/acls/goproxy/conf"
+)
+
+// how often clients without connections and with a full bucket are
+// forgotten
+const clientSweepInterval = time.Minute
+
+// clientLimiter rate limits new connections with a token bucket per client
+// network and caps their concurrent connections
+type clientLimiter struct {
+	rate           float64
+	burst          float64
+	maxConnections int
+	v4Mask, v6Mask net.IPMask
+	allow          []*net.IPNet
+
+	mu        sync.Mutex
+	clients   map[string]*clientState
+	lastSweep time.Time
+}
+
+type clientState struct {
+	tokens float64
+	// when tokens was last refilled
+	last   time.Time
+	active int
+}
+
+func newClientLimiter(config *conf.ClientLimits) (*clientLimiter, error) {
+	allow, err := conf.ParseCIDRs(config.Allow)
+	if err != nil {
+		return nil, err
+	}
+	return &clientLimiter{
+		rate:           config.Rate,
+		burst:          float64(config.Burst),
+		maxConnections: config.MaxConnections,
+		v4Mask:         net.CIDRMask(config.IPv4Prefix, 32),
+		v6Mask:         net.CIDRMask(config.IPv6Prefix, 128),
+		allow:          allow,
+		clients:        make(map[string]*clientState),
+		lastSweep:      time.Now(),
+	}, nil
+}
+
+// key returns the client's network, empty if the client isn't limited
+func (cl *clientLimiter) key(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	for _, n := range cl.allow {
+		if n.Contains(ip) {
+			return ""
+		}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(cl.v4Mask).String()
+	}
+	return ip.Mask(cl.v6Mask).String()
+}
+
+// acquire counts a new connection of the client, it returns the reason if
+// the client is over a limit
+func (cl *clientLimiter) acquire(key string, now time.Time) (reason string, ok bool) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if now.Sub(cl.lastSweep) > clientSweepInterval {
+		cl.sweep(now)
+	}
+
+	st, found := cl.clients[key]
+	if !found {
+		st = &clientState{tokens: cl.burst, last: now}
+		cl.clients[key] = st
+	}
+	if cl.maxConnections > 0 && st.active >= cl.maxConnections {
+		return "max_connections", false
+	}
+	if cl.rate > 0 {
+		cl.refill(st, now)
+		if st.tokens < 1 {
+			return "rate", false
+		}
+		st.tokens--
+	}
+	st.active++
+	return "", true
+}
+
+// release uncounts a connection counted by acquire
+func (cl *clientLimiter) release(key string) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if st, ok := cl.clients[key]; ok {
+		st.active--
+	}
+}
+
+func (cl *clientLimiter) refill(st *clientState, now time.Time) {
+	st.tokens += now.Sub(st.last).Seconds() * cl.rate
+	if st.tokens > cl.burst {
+		st.tokens = cl.burst
+	}
+	st.last = now
+}
+
+// sweep forgets the clients that are back to their initial state
+func (cl *clientLimiter) sweep(now time.Time) {
+	for key, st := range cl.clients {
+		if cl.rate > 0 {
+			cl.refill(st, now)
+		}
+		if st.active == 0 && (cl.rate == 0 || st.tokens >= cl.burst) {
+			delete(cl.clients, key)
+		}
+	}
+	cl.lastSweep = now
+}
+
+// clientLimitCheck closes the connections of clients over their limits
+// before anything is read from them
+type clientLimitCheck struct {
+	*zap.Logger
+	limiter  *clientLimiter
+	bindAddr string
+}
+
+func (cc *clientLimitCheck) check(c net.Conn) (net.Conn, bool) {
+	key := cc.limiter.key(addrIP(c.RemoteAddr()))
+	if key == "" {
+		return c, true
+	}
+	if reason, ok := cc.limiter.acquire(key, time.Now()); !ok {
+		clientLimitedConnections.WithLabelValues(cc.bindAddr, reason).Inc()
+		cc.Debug("Client over its limit",
+			zap.String("from", c.RemoteAddr().String()),
+			zap.String("reason", reason),
+		)
+		c.Close()
+		return nil, false
+	}
+	return &clientConn{Conn: c, limiter: cc.limiter, key: key}, true
+}
+
+// clientConn releases its client's connection once closed
+type clientConn struct {
+	net.Conn
+	limiter *clientLimiter
+	key     string
+	once    sync.Once
+}
+
+func (c *clientConn) Close() error {
+	c.once.Do(func() { c.limiter.release(c.key) })
+	return c.Conn.Close()
+}
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/acls/goproxy/conf"
+	"go.uber.org/zap"
+)
+
+func mkClientLimiter(t *testing.T, config *conf.ClientLimits) *clientLimiter {
+	if err := config.SetDefaultsAndValidate(); err != nil {
+		t.Fatalf("Invalid client limits: %v", err)
+	}
+	cl, err := newClientLimiter(config)
+	if err != nil {
+		t.Fatalf("Failed to create client limiter: %v", err)
+	}
+	return cl
+}
+
+func TestClientLimiterRate(t *testing.T) {
+	cl := mkClientLimiter(t, &conf.ClientLimits{Rate: 2, Burst: 2})
+	key := cl.key(net.ParseIP("192.0.2.1"))
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if _, ok := cl.acquire(key, now); !ok {
+			t.Fatalf("Expected connection %d of the burst to be allowed", i)
+		}
+	}
+	if reason, ok := cl.acquire(key, now); ok || reason != "rate" {
+		t.Errorf("Expected a rate limit, got %q", reason)
+	}
+	// a token every half second
+	if _, ok := cl.acquire(key, now.Add(500*time.Millisecond)); !ok {
+		t.Errorf("Expected a refilled token")
+	}
+
+	// other clients have their own bucket
+	if _, ok := cl.acquire(cl.key(net.ParseIP("192.0.2.2")), now); !ok {
+		t.Errorf("Expected another client to be allowed")
+	}
+}
+
+func TestClientLimiterMaxConnections(t *testing.T) {
+	cl := mkClientLimiter(t, &conf.ClientLimits{
+		MaxConnections: 1,
+		IPv4Prefix:     24,
+		Allow:          []string{"198.51.100.0/24"},
+	})
+	now := time.Now()
+
+	key := cl.key(net.ParseIP("192.0.2.1"))
+	if _, ok := cl.acquire(key, now); !ok {
+		t.Fatalf("Expected the first connection to be allowed")
+	}
+	// the same /24
+	if other := cl.key(net.ParseIP("192.0.2.200")); other != key {
+		t.Errorf("Expected the same client for the /24, got %q and %q", key, other)
+	}
+	if reason, ok := cl.acquire(key, now); ok || reason != "max_connections" {
+		t.Errorf("Expected a max connections limit, got %q", reason)
+	}
+	cl.release(key)
+	if _, ok := cl.acquire(key, now); !ok {
+		t.Errorf("Expected a connection after the first was released")
+	}
+
+	if key := cl.key(net.ParseIP("198.51.100.7")); key != "" {
+		t.Errorf("Expected an allowed client not to be limited, got %q", key)
+	}
+
+	// idle clients are forgotten
+	cl.release(key)
+	cl.acquire(cl.key(net.ParseIP("203.0.113.1")), now.Add(2*clientSweepInterval))
+	if _, ok := cl.clients[key]; ok {
+		t.Errorf("Expected the idle client to be swept")
+	}
+}
+
+func TestClientLimitCheck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	cl := mkClientLimiter(t, &conf.ClientLimits{MaxConnections: 1})
+	l = newCheckListener(l, (&clientLimitCheck{Logger: zap.NewNop(), limiter: cl, bindAddr: l.Addr().String()}).check)
+	defer l.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c
+		}
+	}()
+
+	first, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer first.Close()
+	in := <-accepted
+
+	over, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer over.Close()
+	expectClosed(t, over, 2*time.Second)
+
+	// closing the first connection makes room for another
+	in.Close()
+	next, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer next.Close()
+	select {
+	case c := <-accepted:
+		c.Close()
+	case <-time.After(2 * time.Second):
+		t.Errorf("Expected the connection to be accepted")
+	}
+}
@@ -2,40 +2,116 @@ package proxy
 
 import (
 	"crypto/tls"
+	"errors"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	vhost "github.com/acls/go-vhost"
+	"github.com/acls/goproxy/conf"
 	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+)
+
+var (
+	errNoBackend    = errors.New("No backend available")
+	errBackendLimit = errors.New("Backends are at their max connections")
 )
 
 type frontend struct {
-	stopped   bool
+	stopped   int32
 	Name      string
 	BoundAddr string
 	*zap.Logger
 	TLSConfig *tls.Config
-	Listener  net.Listener
-	Strategy  BackendStrategy
+	// Autocert certificates are managed by ACME
+	Autocert bool
+	Listener net.Listener
+	Strategy BackendStrategy
+	// Network backends are dialed on, tcp if empty
+	Network string
+
+	// Retries is the number of other backends to try when a dial fails
+	Retries int
+	// MaxFails consecutive dial failures eject a backend for FailTimeout
+	MaxFails    int
+	FailTimeout time.Duration
+
+	// disabled if 0
+	IdleTimeout           time.Duration
+	MaxConnectionDuration time.Duration
+	HalfCloseTimeout      time.Duration
+	HandshakeTimeout      time.Duration
+
+	checkers []*healthChecker
+	// stops watching the certificate files
+	unwatch func()
+
+	config   *conf.Frontend
+	backends []*backend
+	// the server's count of proxied connections
+	sessions *int64
+	// the server's proxied connections
+	conns *connSet
+	// max connections of the frontend and of the server's binding
+	limit        *limiter
+	bindingLimit *limiter
+	// allows or denies clients once their connections are routed here
+	acl *acl
+}
+
+func (f *frontend) status() FrontendStatus {
+	status := FrontendStatus{
+		Name:     f.Name,
+		Config:   f.config,
+		Backends: make([]BackendStatus, len(f.backends)),
+	}
+	for i, b := range f.backends {
+		status.Backends[i] = BackendStatus{
+			Addr:    b.Addr,
+			Weight:  b.GetWeight(),
+			Healthy: b.healthy(),
+			Ejected: b.ejected(),
+			Active:  int(atomic.LoadInt32(&b.active)),
+		}
+	}
+	return status
 }
 
 func (f *frontend) Stop() error {
-	f.stopped = true
+	atomic.StoreInt32(&f.stopped, 1)
+	for _, c := range f.checkers {
+		c.Stop()
+	}
+	if f.unwatch != nil {
+		f.unwatch()
+	}
 	return f.Listener.Close()
 }
+func (f *frontend) isStopped() bool {
+	return atomic.LoadInt32(&f.stopped) == 1
+}
+
 func (f *frontend) Run() {
+	for _, c := range f.checkers {
+		go c.Run()
+	}
 	f.Info("Handling connections",
 		zap.String("listener", f.BoundAddr),
 		zap.String("frontend", f.Name),
 	)
 	for {
-		if f.stopped {
+		if f.isStopped() {
 			return
 		}
 		// accept next connection to this frontend
 		conn, err := f.Listener.Accept()
-		if f.stopped {
+		if f.isStopped() {
+			if err == nil {
+				conn.Close()
+			}
 			return
 		}
 		if err != nil {
@@ -47,10 +123,14 @@ func (f *frontend) Run() {
 			}
 			return
 		}
+		if f.denied(conn) {
+			continue
+		}
 		f.Debug("Accepted new connection",
 			zap.String("name", f.Name),
 			zap.String("from", conn.RemoteAddr().String()),
 		)
+		acceptedConnections.WithLabelValues(f.BoundAddr, f.Name).Inc()
 
 		// proxy the connection to an backend
 		go f.proxyConnection(conn)
@@ -58,41 +138,254 @@ func (f *frontend) Run() {
 }
 
 func (f *frontend) proxyConnection(c net.Conn) (err error) {
+	// the frontend's limit first so its queue doesn't hold the binding's slots
+	if err := f.limit.acquire(); err != nil {
+		f.reject(c, "frontend_limit", err)
+		return err
+	}
+	defer f.limit.release()
+	if err := f.bindingLimit.acquire(); err != nil {
+		f.reject(c, "binding_limit", err)
+		return err
+	}
+	defer f.bindingLimit.release()
+
+	if f.sessions != nil {
+		atomic.AddInt64(f.sessions, 1)
+		defer atomic.AddInt64(f.sessions, -1)
+	}
+	if f.conns != nil {
+		f.conns.add(c)
+		defer f.conns.remove(c)
+	}
+	active := activeConnections.WithLabelValues(f.BoundAddr, f.Name)
+	active.Inc()
+	defer active.Dec()
+	defer func(start time.Time) {
+		connectionDuration.WithLabelValues(f.BoundAddr, f.Name).Observe(time.Since(start).Seconds())
+	}(time.Now())
+
+	ctx := &connContext{conn: c, serverName: connHost(c)}
+
 	// unwrap if tls cert/key was specified
 	if f.TLSConfig != nil {
-		c = tls.Server(c, f.TLSConfig)
+		tlsConn := tls.Server(c, f.TLSConfig)
+		if f.HandshakeTimeout > 0 {
+			c.SetDeadline(time.Now().Add(f.HandshakeTimeout))
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			f.Debug("TLS handshake failed",
+				zap.String("frontend", f.Name),
+				zap.String("from", c.RemoteAddr().String()),
+				zap.Error(err),
+			)
+			c.Close()
+			return err
+		}
+		c.SetDeadline(time.Time{})
+		state := tlsConn.ConnectionState()
+		// TLS-ALPN-01 challenges are done once the handshake is
+		if state.NegotiatedProtocol == acme.ALPNProto {
+			return tlsConn.Close()
+		}
+		ctx.tlsState = &state
+		c = tlsConn
 	}
 
-	// pick the backend
-	backend := f.Strategy.NextBackend()
-
-	// dial the backend
-	upConn, err := net.DialTimeout("tcp", backend.Addr, time.Duration(backend.ConnectTimeout)*time.Millisecond)
+	// pick and dial the backend
+	backend, upConn, err := f.dialBackend(ctx)
+	if err == errBackendLimit {
+		f.reject(c, "backend_limit", err)
+		return
+	}
 	if err != nil {
-		f.Error("Failed to dial backend connection",
-			zap.String("backend", backend.Addr),
+		f.Error("Failed to connect to a backend",
+			zap.String("frontend", f.Name),
 			zap.Error(err),
 		)
 		c.Close()
 		return
 	}
+	defer backend.release()
 	f.Debug("Initiated new connection to backend",
 		zap.String("from", upConn.LocalAddr().String()),
 		zap.String("to", upConn.RemoteAddr().String()),
 	)
 
 	// join the connections
-	f.joinConnections(c, upConn)
+	f.joinConnections(c, upConn, backend)
 	return
 }
 
-func (f *frontend) joinConnections(c1 net.Conn, c2 net.Conn) {
+// denied closes the connection unless the frontend's acl allows its client
+func (f *frontend) denied(c net.Conn) bool {
+	if f.acl.allows(c.RemoteAddr()) {
+		return false
+	}
+	deniedConnections.WithLabelValues(f.BoundAddr, f.Name).Inc()
+	f.Info("Denied connection",
+		zap.String("frontend", f.Name),
+		zap.String("from", c.RemoteAddr().String()),
+	)
+	c.Close()
+	return true
+}
+
+// reject closes a connection over a connection limit
+func (f *frontend) reject(c net.Conn, reason string, err error) {
+	rejectedConnections.WithLabelValues(f.BoundAddr, f.Name, reason).Inc()
+	f.Warn("Rejected connection",
+		zap.String("frontend", f.Name),
+		zap.String("from", c.RemoteAddr().String()),
+		zap.String("reason", reason),
+		zap.Error(err),
+	)
+	c.Close()
+}
+
+// connHost returns the SNI or Host name the vhost muxer matched the
+// connection by
+func connHost(c net.Conn) string {
+	if vc, ok := c.(interface {
+		Host() string
+	}); ok {
+		return vc.Host()
+	}
+	return ""
+}
+
+// dialBackend dials backends picked by the strategy for the client
+// connection until one connects or the retries run out
+func (f *frontend) dialBackend(ctx *connContext) (*backend, net.Conn, error) {
+	err := errNoBackend
+	for attempt := 0; attempt <= f.Retries; attempt++ {
+		backend := f.Strategy.NextBackend(ctx)
+		if backend == nil {
+			break
+		}
+		// it filled up since it was picked, that's not a failed attempt
+		if !backend.acquire() {
+			ctx.tried = append(ctx.tried, backend)
+			attempt--
+			continue
+		}
+
+		start := time.Now()
+		upConn, dialErr := f.dial(ctx, backend)
+		if dialErr == nil {
+			dialDuration.WithLabelValues(f.BoundAddr, f.Name, backend.Addr).Observe(time.Since(start).Seconds())
+			backend.dialSucceeded()
+			return backend, upConn, nil
+		}
+		dialFailures.WithLabelValues(f.BoundAddr, f.Name, backend.Addr).Inc()
+		backend.release()
+		err = dialErr
+		ctx.tried = append(ctx.tried, backend)
+
+		f.Error("Failed to dial backend connection",
+			zap.String("frontend", f.Name),
+			zap.String("backend", backend.Addr),
+			zap.Int("attempt", attempt+1),
+			zap.Error(err),
+		)
+		if backend.dialFailed(f.MaxFails, f.FailTimeout) {
+			f.Warn("Backend ejected after consecutive dial failures",
+				zap.String("frontend", f.Name),
+				zap.String("backend", backend.Addr),
+				zap.Int("fails", f.MaxFails),
+				zap.Duration("cooldown", f.FailTimeout),
+			)
+		}
+	}
+	if err == errNoBackend && f.backendsFull() {
+		err = errBackendLimit
+	}
+	return nil, nil, err
+}
+
+// backendsFull returns whether a backend would be available if it wasn't
+// at its max connections
+func (f *frontend) backendsFull() bool {
+	for _, b := range f.backends {
+		if b.full() && b.GetWeight() > 0 && b.healthy() && !b.ejected() {
+			return true
+		}
+	}
+	return false
+}
+
+// dial connects to the backend, sends it the PROXY protocol header if it
+// wants one and then starts TLS if it has tls
+func (f *frontend) dial(ctx *connContext, backend *backend) (net.Conn, error) {
+	timeout := time.Duration(backend.ConnectTimeout) * time.Millisecond
+	network := f.Network
+	if network == "" {
+		network = "tcp"
+	}
+	upConn, err := net.DialTimeout(network, backend.Addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if backend.SendProxyProtocol != "" {
+		h := newProxyHeader(ctx.conn, ctx.serverName)
+		h.TLS = ctx.tlsState
+		if err := h.WriteVersion(upConn, backend.SendProxyProtocol); err != nil {
+			upConn.Close()
+			return nil, err
+		}
+	}
+
+	if backend.tlsConfig != nil {
+		tlsConn := tls.Client(upConn, backend.tlsConfig)
+		if timeout > 0 {
+			tlsConn.SetDeadline(time.Now().Add(timeout))
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			upConn.Close()
+			return nil, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		upConn = tlsConn
+	}
+	return upConn, nil
+}
+
+// joinConnections copies between the connections until both sides are
+// done, or the timeouts close them. When one side is done its peer is half
+// closed, so it reads EOF and can still reply.
+func (f *frontend) joinConnections(c1 net.Conn, c2 net.Conn, backend *backend) {
+	var closeOnce sync.Once
+	closeBoth := func() {
+		closeOnce.Do(func() {
+			c1.Close()
+			c2.Close()
+		})
+	}
+	defer closeBoth()
+
+	if f.MaxConnectionDuration > 0 {
+		t := time.AfterFunc(f.MaxConnectionDuration, func() {
+			f.Debug("Closing connection after the max connection duration",
+				zap.String("from", c1.RemoteAddr().String()),
+				zap.String("to", c2.RemoteAddr().String()),
+				zap.Duration("duration", f.MaxConnectionDuration),
+			)
+			closeBoth()
+		})
+		defer t.Stop()
+	}
+
+	// unix nanoseconds of the last data either way
+	lastActive := time.Now().UnixNano()
+	var halfClose sync.Once
+	var halfCloseTimer *time.Timer
+
 	var wg sync.WaitGroup
-	halfJoin := func(dst net.Conn, src net.Conn) {
+	halfJoin := func(dst net.Conn, src net.Conn, direction string) {
 		defer wg.Done()
-		defer dst.Close()
-		defer src.Close()
-		n, err := io.Copy(dst, src)
+		n, err := copyConn(dst, src, f.IdleTimeout, &lastActive)
+		bytesCopied.WithLabelValues(f.BoundAddr, f.Name, backend.Addr, direction).Add(float64(n))
 		if err != nil {
 			f.Debug("Copy failed after N bytes",
 				zap.String("from", src.RemoteAddr().String()),
@@ -107,6 +400,17 @@ func (f *frontend) joinConnections(c1 net.Conn, c2 net.Conn) {
 				zap.Int64("bytes", n),
 			)
 		}
+
+		if err != nil || !closeWrite(dst) {
+			closeBoth()
+			return
+		}
+		// the first side to finish gives the other the half close timeout
+		if f.HalfCloseTimeout > 0 {
+			halfClose.Do(func() {
+				halfCloseTimer = time.AfterFunc(f.HalfCloseTimeout, closeBoth)
+			})
+		}
 	}
 
 	f.Debug("Joining connections",
@@ -114,7 +418,66 @@ func (f *frontend) joinConnections(c1 net.Conn, c2 net.Conn) {
 		zap.String("to", c2.RemoteAddr().String()),
 	)
 	wg.Add(2)
-	go halfJoin(c1, c2)
-	go halfJoin(c2, c1)
+	go halfJoin(c1, c2, directionOut)
+	go halfJoin(c2, c1, directionIn)
 	wg.Wait()
+	if halfCloseTimer != nil {
+		halfCloseTimer.Stop()
+	}
+}
+
+// closeWrite shuts down the writing side of the connection, TLS ones send
+// a close_notify. It returns false if the connection can't be half closed.
+func closeWrite(c net.Conn) bool {
+	switch conn := c.(type) {
+	case *vhost.TLSConn:
+		return closeWrite(conn.Conn)
+	case *vhost.HTTPConn:
+		return closeWrite(conn.Conn)
+	case *proxyProtoConn:
+		return closeWrite(conn.Conn)
+	case *clientConn:
+		return closeWrite(conn.Conn)
+	case interface{ CloseWrite() error }:
+		return conn.CloseWrite() == nil
+	}
+	return false
+}
+
+// copyConn copies like io.Copy. With an idle timeout it fails once there
+// was no data either way for that long, lastActive is shared by both
+// directions of a connection.
+func copyConn(dst net.Conn, src net.Conn, idle time.Duration, lastActive *int64) (int64, error) {
+	if idle <= 0 {
+		return io.Copy(dst, src)
+	}
+
+	buf := make([]byte, 32*1024)
+	var written int64
+	for {
+		src.SetReadDeadline(time.Unix(0, atomic.LoadInt64(lastActive)).Add(idle))
+		nr, err := src.Read(buf)
+		if nr > 0 {
+			atomic.StoreInt64(lastActive, time.Now().UnixNano())
+			dst.SetWriteDeadline(time.Now().Add(idle))
+			nw, werr := dst.Write(buf[:nr])
+			written += int64(nw)
+			if werr != nil {
+				return written, werr
+			}
+			if nw != nr {
+				return written, io.ErrShortWrite
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			// the other direction may have had data since the deadline was set
+			if isTimeout(err) && time.Now().Before(time.Unix(0, atomic.LoadInt64(lastActive)).Add(idle)) {
+				continue
+			}
+			return written, err
+		}
+	}
 }
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/acls/goproxy/conf"
+	"go.uber.org/zap"
+)
+
+// healthChecker periodically checks a backend and marks it healthy or
+// unhealthy once enough consecutive checks pass or fail
+type healthChecker struct {
+	*zap.Logger
+	frontend string
+	backend  *backend
+	check    conf.HealthCheck
+	stop     chan struct{}
+	// the SNI and Host header of checks
+	host string
+
+	passes int
+	fails  int
+}
+
+func newHealthChecker(log *zap.Logger, frontend string, b *backend) *healthChecker {
+	return &healthChecker{
+		Logger:   log,
+		frontend: frontend,
+		backend:  b,
+		check:    *b.HealthCheck,
+		host:     checkHost(b.HealthCheck.Host, frontend, b.Addr),
+		stop:     make(chan struct{}),
+	}
+}
+
+// checkHost returns the check's host if it has one, else the frontend's
+// name unless it's a pattern or a tcp binding's address, else the
+// backend's host
+func checkHost(host, frontend, backendAddr string) string {
+	if host != "" {
+		return host
+	}
+	if !isPattern(frontend) && !strings.Contains(frontend, ":") {
+		return frontend
+	}
+	if h, _, err := net.SplitHostPort(backendAddr); err == nil && h != "" {
+		return h
+	}
+	return "localhost"
+}
+
+// Run checks the backend every interval until stopped
+func (c *healthChecker) Run() {
+	t := time.NewTicker(time.Duration(c.check.Interval) * time.Millisecond)
+	defer t.Stop()
+	for {
+		c.record(c.checkOnce())
+		select {
+		case <-c.stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Stop stops checking the backend
+func (c *healthChecker) Stop() {
+	close(c.stop)
+}
+
+func (c *healthChecker) record(err error) {
+	if err == nil {
+		c.fails = 0
+		c.passes++
+		if !c.backend.healthy() && c.passes >= c.check.Rise {
+			c.backend.setHealthy(true)
+			c.Info("Backend is healthy",
+				zap.String("frontend", c.frontend),
+				zap.String("backend", c.backend.Addr),
+			)
+		}
+		return
+	}
+
+	c.passes = 0
+	c.fails++
+	c.Debug("Health check failed",
+		zap.String("frontend", c.frontend),
+		zap.String("backend", c.backend.Addr),
+		zap.Error(err),
+	)
+	if c.backend.healthy() && c.fails >= c.check.Fall {
+		c.backend.setHealthy(false)
+		c.Warn("Backend is unhealthy",
+			zap.String("frontend", c.frontend),
+			zap.String("backend", c.backend.Addr),
+			zap.Error(err),
+		)
+	}
+}
+
+func (c *healthChecker) checkOnce() error {
+	timeout := time.Duration(c.check.Timeout) * time.Millisecond
+	conn, err := net.DialTimeout("tcp", c.backend.Addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	// backends expecting a PROXY header would drop the check without one
+	if c.backend.SendProxyProtocol != "" {
+		h := &proxyHeader{Local: true}
+		if err := h.WriteVersion(conn, c.backend.SendProxyProtocol); err != nil {
+			return err
+		}
+	}
+
+	if c.check.TLS || c.backend.tlsConfig != nil {
+		// without backend tls only liveness is checked, not the backend's identity
+		cfg := c.backend.tlsConfig
+		if cfg == nil {
+			cfg = &tls.Config{
+				ServerName:         c.host,
+				InsecureSkipVerify: true,
+			}
+		}
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.Handshake(); err != nil {
+			return err
+		}
+		conn = tlsConn
+	}
+
+	if c.check.HTTPPath == "" {
+		return nil
+	}
+
+	req, err := http.NewRequest("GET", c.check.HTTPPath, nil)
+	if err != nil {
+		return err
+	}
+	req.Host = c.host
+	req.Close = true
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("Unexpected status: %s", resp.Status)
+	}
+	return nil
+}
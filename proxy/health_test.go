@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/acls/goproxy/conf"
+	"go.uber.org/zap"
+)
+
+func mkHealthChecker(addr string, check conf.HealthCheck) *healthChecker {
+	if err := check.SetDefaultsAndValidate(); err != nil {
+		panic(err)
+	}
+	b := newBackends([]conf.Backend{conf.Backend{Addr: addr, HealthCheck: &check}})[0]
+	return newHealthChecker(zap.L(), "test.example.com", b)
+}
+
+func TestHealthCheckRiseFall(t *testing.T) {
+	c := mkHealthChecker("127.0.0.1:0", conf.HealthCheck{Rise: 2, Fall: 3})
+	fail := errors.New("fail")
+
+	for i := 0; i < 2; i++ {
+		c.record(fail)
+		if !c.backend.available() {
+			t.Fatalf("Expected backend to stay healthy after %v failures", i+1)
+		}
+	}
+	c.record(fail)
+	if c.backend.available() {
+		t.Fatalf("Expected backend to be unhealthy after 3 failures")
+	}
+
+	c.record(nil)
+	if c.backend.available() {
+		t.Fatalf("Expected backend to stay unhealthy after 1 pass")
+	}
+	c.record(nil)
+	if !c.backend.available() {
+		t.Fatalf("Expected backend to be healthy after 2 passes")
+	}
+}
+
+func TestHealthCheckTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := l.Addr().String()
+
+	c := mkHealthChecker(addr, conf.HealthCheck{})
+	if err := c.checkOnce(); err != nil {
+		t.Errorf("Expected check to pass, got %v", err)
+	}
+
+	l.Close()
+	if err := c.checkOnce(); err == nil {
+		t.Errorf("Expected check to fail on a closed listener")
+	}
+}
+
+func TestHealthCheckHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	c := mkHealthChecker(addr, conf.HealthCheck{HTTPPath: "/ok"})
+	if err := c.checkOnce(); err != nil {
+		t.Errorf("Expected check to pass, got %v", err)
+	}
+
+	c = mkHealthChecker(addr, conf.HealthCheck{HTTPPath: "/down"})
+	if err := c.checkOnce(); err == nil {
+		t.Errorf("Expected check to fail on a 503")
+	}
+}
+
+func TestHealthCheckHost(t *testing.T) {
+	hosts := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts <- r.Host
+	}))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	tests := []struct {
+		frontend string
+		host     string
+		expected string
+	}{
+		{"test.example.com", "", "test.example.com"},
+		{"test.example.com", "health.example.com", "health.example.com"},
+		// patterns and tcp bindings' addresses aren't hosts
+		{"*.example.com", "", "127.0.0.1"},
+		{"~^api[0-9]+\\.example\\.com$", "", "127.0.0.1"},
+		{"127.0.0.1:55111", "", "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		check := conf.HealthCheck{HTTPPath: "/", Host: tt.host}
+		check.SetDefaultsAndValidate()
+		b := newBackends([]conf.Backend{conf.Backend{Addr: addr, HealthCheck: &check}})[0]
+		c := newHealthChecker(zap.L(), tt.frontend, b)
+		if err := c.checkOnce(); err != nil {
+			t.Fatalf("Expected check to pass for %v, got %v", tt.frontend, err)
+		}
+		if got := <-hosts; got != tt.expected {
+			t.Errorf("Wrong host for %v. Got %q, expected %q", tt.frontend, got, tt.expected)
+		}
+	}
+}
+
+func TestHealthCheckProxyProtocol(t *testing.T) {
+	for _, version := range []string{conf.ProxyProtocolV1, conf.ProxyProtocolV2} {
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		// the backend drops connections without a header
+		srv.Listener = newProxyProtoListener(srv.Listener, time.Second)
+		srv.Start()
+
+		check := conf.HealthCheck{HTTPPath: "/"}
+		check.SetDefaultsAndValidate()
+		b := newBackends([]conf.Backend{conf.Backend{
+			Addr:              srv.Listener.Addr().String(),
+			SendProxyProtocol: version,
+			HealthCheck:       &check,
+		}})[0]
+		c := newHealthChecker(zap.L(), "test.example.com", b)
+		if err := c.checkOnce(); err != nil {
+			t.Errorf("%s: Expected check to pass, got %v", version, err)
+		}
+		srv.Close()
+	}
+}
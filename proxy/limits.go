@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	errQueueFull    = errors.New("Over max connections and the queue is full")
+	errQueueTimeout = errors.New("Timed out in the queue for max connections")
+)
+
+// limiter caps concurrent connections, the ones over the cap wait in a
+// bounded queue for a slot. A nil limiter is unlimited.
+type limiter struct {
+	slots   chan struct{}
+	queue   chan struct{}
+	timeout time.Duration
+}
+
+func newLimiter(maxConnections, queueSize int, timeout time.Duration) *limiter {
+	if maxConnections <= 0 {
+		return nil
+	}
+	return &limiter{
+		slots:   make(chan struct{}, maxConnections),
+		queue:   make(chan struct{}, queueSize),
+		timeout: timeout,
+	}
+}
+
+// acquire takes a slot, waiting in the queue if there's room in it
+func (l *limiter) acquire() error {
+	if l == nil {
+		return nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	select {
+	case l.queue <- struct{}{}:
+		defer func() { <-l.queue }()
+	default:
+		return errQueueFull
+	}
+	t := time.NewTimer(l.timeout)
+	defer t.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-t.C:
+		return errQueueTimeout
+	}
+}
+
+// release frees a slot taken by acquire
+func (l *limiter) release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+const (
+	// the first passed file descriptor, after stdin, stdout and stderr
+	listenFdsStart = 3
+
+	// InheritFdsEnv is the number of listeners passed to an upgraded process
+	InheritFdsEnv = "GOPROXY_INHERIT_FDS"
+)
+
+// Listeners are listening sockets passed to the process, by systemd socket
+// activation or by the goproxy process that started it for an upgrade
+type Listeners struct {
+	mu        sync.Mutex
+	listeners []net.Listener
+	// of udp bindings
+	packetConns []net.PacketConn
+}
+
+// InheritListeners takes the listeners passed to the process
+func InheritListeners() (*Listeners, error) {
+	n := 0
+	var err error
+	if pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID")); pid == os.Getpid() {
+		n, err = strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	} else if v := os.Getenv(InheritFdsEnv); v != "" {
+		n, err = strconv.Atoi(v)
+	}
+	// they're not for our own children
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	os.Unsetenv(InheritFdsEnv)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid number of passed listeners: %v", err)
+	}
+
+	ls := &Listeners{}
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "listener")
+		l, err := net.FileListener(f)
+		if err != nil {
+			pc, pcErr := net.FilePacketConn(f)
+			f.Close()
+			if pcErr != nil {
+				ls.Close()
+				return nil, fmt.Errorf("Passed file descriptor %d isn't a listener: %v", fd, err)
+			}
+			ls.packetConns = append(ls.packetConns, pc)
+			continue
+		}
+		f.Close()
+		ls.listeners = append(ls.listeners, l)
+	}
+	return ls, nil
+}
+
+// Listen takes the passed listener for the address, or listens on it if
+// there isn't one
+func (ls *Listeners) Listen(network, addr string) (net.Listener, error) {
+	if l := ls.Take(network, addr); l != nil {
+		return l, nil
+	}
+	return net.Listen(network, addr)
+}
+
+// Take removes and returns the passed listener for the address, nil if
+// there isn't one
+func (ls *Listeners) Take(network, addr string) net.Listener {
+	if ls == nil {
+		return nil
+	}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	for i, l := range ls.listeners {
+		if addrMatches(l.Addr(), network, addr) {
+			ls.listeners = append(ls.listeners[:i], ls.listeners[i+1:]...)
+			return l
+		}
+	}
+	return nil
+}
+
+// ListenPacket takes the passed packet conn for the address, or listens on
+// it if there isn't one
+func (ls *Listeners) ListenPacket(network, addr string) (net.PacketConn, error) {
+	if pc := ls.TakePacketConn(network, addr); pc != nil {
+		return pc, nil
+	}
+	return net.ListenPacket(network, addr)
+}
+
+// TakePacketConn removes and returns the passed packet conn for the
+// address, nil if there isn't one
+func (ls *Listeners) TakePacketConn(network, addr string) net.PacketConn {
+	if ls == nil {
+		return nil
+	}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	for i, pc := range ls.packetConns {
+		if addrMatches(pc.LocalAddr(), network, addr) {
+			ls.packetConns = append(ls.packetConns[:i], ls.packetConns[i+1:]...)
+			return pc
+		}
+	}
+	return nil
+}
+
+// Close closes the listeners that weren't taken
+func (ls *Listeners) Close() {
+	if ls == nil {
+		return
+	}
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	for _, l := range ls.listeners {
+		l.Close()
+	}
+	for _, pc := range ls.packetConns {
+		pc.Close()
+	}
+	ls.listeners = nil
+	ls.packetConns = nil
+}
+
+// addrMatches returns whether a socket bound to la is bound to the
+// address. Unspecified hosts like ":443" match sockets on any address.
+func addrMatches(la net.Addr, network, addr string) bool {
+	var ip, wantIP net.IP
+	var port, wantPort int
+	switch la := la.(type) {
+	case *net.UnixAddr:
+		return network == "unix" && la.Name == addr
+	case *net.TCPAddr:
+		want, err := net.ResolveTCPAddr(network, addr)
+		if network != "tcp" || err != nil {
+			return false
+		}
+		ip, port, wantIP, wantPort = la.IP, la.Port, want.IP, want.Port
+	case *net.UDPAddr:
+		want, err := net.ResolveUDPAddr(network, addr)
+		if network != "udp" || err != nil {
+			return false
+		}
+		ip, port, wantIP, wantPort = la.IP, la.Port, want.IP, want.Port
+	default:
+		return false
+	}
+
+	if wantPort != port {
+		return false
+	}
+	if wantIP == nil || wantIP.IsUnspecified() {
+		return ip == nil || ip.IsUnspecified()
+	}
+	return wantIP.Equal(ip)
+}
+
+// ListenerFile returns a duplicate of the socket of a listener or packet
+// conn to pass to another process
+func ListenerFile(l interface{}) (*os.File, error) {
+	fl, ok := l.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("Can't get the file of a %T", l)
+	}
+	return fl.File()
+}
+
+// DupListener returns a listener on the same socket as l, it keeps
+// listening once l is closed
+func DupListener(l net.Listener) (net.Listener, error) {
+	f, err := ListenerFile(l)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// DupPacketConn returns a packet conn on the same socket as pc, it keeps
+// receiving once pc is closed
+func DupPacketConn(pc net.PacketConn) (net.PacketConn, error) {
+	f, err := ListenerFile(pc)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return net.FilePacketConn(f)
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestListenerMatches(t *testing.T) {
+	wildcard, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer wildcard.Close()
+	_, port, _ := net.SplitHostPort(wildcard.Addr().String())
+
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer local.Close()
+	_, localPort, _ := net.SplitHostPort(local.Addr().String())
+
+	for _, test := range []struct {
+		l       net.Listener
+		network string
+		addr    string
+		matches bool
+	}{
+		{wildcard, "tcp", ":" + port, true},
+		{wildcard, "tcp", "0.0.0.0:" + port, true},
+		{wildcard, "tcp", "127.0.0.1:" + port, false},
+		{wildcard, "unix", ":" + port, false},
+		{local, "tcp", "127.0.0.1:" + localPort, true},
+		{local, "tcp", "localhost:" + localPort, true},
+		{local, "tcp", ":" + localPort, false},
+		{local, "tcp", "127.0.0.1:" + port, false},
+	} {
+		if got := addrMatches(test.l.Addr(), test.network, test.addr); got != test.matches {
+			t.Errorf("Expected %v for %v on %v, got %v", test.matches, test.addr, test.l.Addr(), got)
+		}
+	}
+}
+
+func TestListenersTake(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	dir, err := ioutil.TempDir("", "goproxy-listeners")
+	if err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	sock := path.Join(dir, "admin.sock")
+	ul, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ul.Close()
+
+	// passed like it would be to another process
+	var ls Listeners
+	for _, l := range []net.Listener{l, ul} {
+		f, err := ListenerFile(l)
+		if err != nil {
+			t.Fatalf("Failed to get listener file: %v", err)
+		}
+		fl, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("Failed to make listener from file: %v", err)
+		}
+		ls.listeners = append(ls.listeners, fl)
+	}
+
+	if got := ls.Take("unix", sock); got == nil {
+		t.Errorf("Expected the unix socket to be passed")
+	}
+	got, err := ls.Listen("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	if got.Addr().String() != l.Addr().String() {
+		t.Errorf("Expected the passed listener, got %v", got.Addr())
+	}
+
+	// the passed listener accepts connections for the same socket
+	go func() {
+		if c, err := net.Dial("tcp", l.Addr().String()); err == nil {
+			c.Close()
+		}
+	}()
+	c, err := got.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept on passed listener: %v", err)
+	}
+	c.Close()
+	got.Close()
+
+	if got := ls.Take("tcp", l.Addr().String()); got != nil {
+		t.Errorf("Expected a listener to only be taken once")
+	}
+}
+
+func TestListenersTakePacketConn(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer pc.Close()
+
+	f, err := ListenerFile(pc)
+	if err != nil {
+		t.Fatalf("Failed to get packet conn file: %v", err)
+	}
+	fpc, err := net.FilePacketConn(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Failed to make packet conn from file: %v", err)
+	}
+	ls := &Listeners{packetConns: []net.PacketConn{fpc}}
+	defer ls.Close()
+
+	if got := ls.Take("tcp", pc.LocalAddr().String()); got != nil {
+		t.Errorf("Expected no tcp listener for a udp socket")
+	}
+	if got := ls.TakePacketConn("udp", pc.LocalAddr().String()); got == nil {
+		t.Errorf("Expected the udp socket to be passed")
+	} else {
+		got.Close()
+	}
+}
+
+func TestDupListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	dup, err := DupListener(l)
+	if err != nil {
+		t.Fatalf("Failed to duplicate listener: %v", err)
+	}
+	defer dup.Close()
+
+	// the socket stays open with the duplicate
+	l.Close()
+	c, err := net.Dial("tcp", dup.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer c.Close()
+	in, err := dup.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept on the duplicate: %v", err)
+	}
+	in.Close()
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/acls/goproxy/conf"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+const (
+	// client to backend
+	directionIn = "in"
+	// backend to client
+	directionOut = "out"
+
+	// timeouts of the metrics and admin HTTP servers, so slow or idle
+	// clients don't hold connections open
+	httpReadTimeout  = 10 * time.Second
+	httpWriteTimeout = 30 * time.Second
+	httpIdleTimeout  = 60 * time.Second
+)
+
+var (
+	acceptedConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goproxy_accepted_connections_total",
+		Help: "Connections accepted by a frontend.",
+	}, []string{"server", "frontend"})
+
+	muxErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goproxy_mux_errors_total",
+		Help: "Connections the muxer couldn't route, by type (not_found, bad_request, other).",
+	}, []string{"server", "type"})
+
+	dialFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goproxy_backend_dial_failures_total",
+		Help: "Failed dials to a backend.",
+	}, []string{"server", "frontend", "backend"})
+
+	dialDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "goproxy_backend_dial_duration_seconds",
+		Help:    "Time to connect to a backend, including any PROXY header and TLS handshake.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+	}, []string{"server", "frontend", "backend"})
+
+	bytesCopied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goproxy_bytes_total",
+		Help: "Bytes copied between clients and a backend, in is client to backend.",
+	}, []string{"server", "frontend", "backend", "direction"})
+
+	rejectedConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goproxy_rejected_connections_total",
+		Help: "Connections closed by a limit, by reason (frontend_limit, binding_limit, backend_limit).",
+	}, []string{"server", "frontend", "reason"})
+
+	clientLimitedConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goproxy_client_limited_connections_total",
+		Help: "Connections closed because their client was over its rate or max connections.",
+	}, []string{"server", "reason"})
+
+	deniedConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goproxy_denied_connections_total",
+		Help: "Connections closed by an allow or deny list, the frontend is empty for the binding's lists.",
+	}, []string{"server", "frontend"})
+
+	activeConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "goproxy_active_connections",
+		Help: "Connections currently being handled by a frontend.",
+	}, []string{"server", "frontend"})
+
+	connectionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "goproxy_connection_duration_seconds",
+		Help:    "Time from accepting a connection to closing it.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 12),
+	}, []string{"server", "frontend"})
+
+	udpSessions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "goproxy_udp_sessions",
+		Help: "UDP sessions currently open.",
+	}, []string{"server", "frontend"})
+
+	udpSessionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goproxy_udp_sessions_total",
+		Help: "UDP sessions started for new client addresses.",
+	}, []string{"server", "frontend"})
+
+	udpDatagrams = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goproxy_udp_datagrams_total",
+		Help: "Datagrams relayed between clients and a backend, in is client to backend.",
+	}, []string{"server", "frontend", "backend", "direction"})
+
+	udpDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "goproxy_udp_dropped_datagrams_total",
+		Help: "Datagrams that couldn't be relayed, by reason (no_backend, denied, pending, backend_write, client_write).",
+	}, []string{"server", "reason"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		acceptedConnections,
+		muxErrors,
+		dialFailures,
+		dialDuration,
+		bytesCopied,
+		rejectedConnections,
+		clientLimitedConnections,
+		deniedConnections,
+		activeConnections,
+		connectionDuration,
+		udpSessions,
+		udpSessionsTotal,
+		udpDatagrams,
+		udpDropped,
+	)
+}
+
+// ServeMetrics serves the metrics in Prometheus text format on the
+// listener until it fails
+func ServeMetrics(log *zap.Logger, m *conf.Metrics, l net.Listener) error {
+	mux := http.NewServeMux()
+	mux.Handle(m.Path, promhttp.Handler())
+	log.Info("Serving metrics",
+		zap.String("addr", l.Addr().String()),
+		zap.String("path", m.Path),
+	)
+	return newHTTPServer(mux).Serve(l)
+}
+
+func newHTTPServer(h http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: httpReadTimeout,
+		ReadTimeout:       httpReadTimeout,
+		WriteTimeout:      httpWriteTimeout,
+		IdleTimeout:       httpIdleTimeout,
+	}
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/acls/goproxy/conf"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	l, addr := backendOrFail(t)
+	name := "metrics.example.com"
+
+	s := mkServer(t, &conf.Binding{
+		Secure:   true,
+		BindAddr: bindAddr,
+		Frontends: map[string]*conf.Frontend{
+			name: &conf.Frontend{
+				BoundAddr: bindAddr,
+				Name:      name,
+				Backends: []conf.Backend{
+					conf.Backend{
+						Addr: addr,
+					},
+				},
+			},
+		},
+	})
+
+	go s.Run()
+	// wait for the listener to bind
+	<-s.Ready()
+	defer s.mux.Close()
+
+	notFound := testutil.ToFloat64(muxErrors.WithLabelValues(bindAddr, "not_found"))
+	if _, err := tls.Dial("tcp", bindAddr, &tls.Config{ServerName: "foo.example.com", InsecureSkipVerify: true}); err == nil {
+		t.Fatalf("Expected error when dialing wrong name, got nil")
+	}
+
+	expected := []byte("Hello World")
+	go func() {
+		out, err := tls.Dial("tcp", bindAddr, &tls.Config{ServerName: name, InsecureSkipVerify: true})
+		if err != nil {
+			t.Errorf("Failed to dial: %v", err)
+			return
+		}
+		out.Write(expected)
+		out.Close()
+	}()
+
+	in, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept new connection: %v", err)
+	}
+	if _, err := ioutil.ReadAll(in); err != nil {
+		t.Fatalf("Error reading data from connection: %v", err)
+	}
+	in.Close()
+
+	// the connection is closed by the proxy after the backend's side is
+	active := activeConnections.WithLabelValues(bindAddr, name)
+	for i := 0; i < 100 && testutil.ToFloat64(active) != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if got := testutil.ToFloat64(muxErrors.WithLabelValues(bindAddr, "not_found")); got != notFound+1 {
+		t.Errorf("Expected one more not found error, got %v", got-notFound)
+	}
+	if got := testutil.ToFloat64(acceptedConnections.WithLabelValues(bindAddr, name)); got != 1 {
+		t.Errorf("Expected 1 accepted connection, got %v", got)
+	}
+	if got := testutil.ToFloat64(active); got != 0 {
+		t.Errorf("Expected no active connections, got %v", got)
+	}
+	// TLS records, not the plaintext, are copied since it's passed through
+	if got := testutil.ToFloat64(bytesCopied.WithLabelValues(bindAddr, name, addr, directionIn)); got <= float64(len(expected)) {
+		t.Errorf("Expected more than %v bytes copied in, got %v", len(expected), got)
+	}
+
+	// exposed in the text format
+	rec := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	for _, metric := range []string{
+		"goproxy_accepted_connections_total",
+		"goproxy_backend_dial_duration_seconds_bucket",
+		"goproxy_connection_duration_seconds_count",
+	} {
+		if !strings.Contains(body, metric) {
+			t.Errorf("Expected %v in metrics", metric)
+		}
+	}
+}
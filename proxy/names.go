@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/acls/goproxy/conf"
+)
+
+var errListenerClosed = errors.New("listener closed")
+
+// isPattern returns whether the frontend name is a wildcard or a regex,
+// those aren't registered with the muxer
+func isPattern(name string) bool {
+	return strings.HasPrefix(name, conf.WildcardPrefix) || strings.HasPrefix(name, conf.RegexpPrefix)
+}
+
+type pattern struct {
+	f *frontend
+	// the name without the "*", for wildcards
+	suffix string
+	re     *regexp.Regexp
+}
+
+func newPattern(name string) (*pattern, error) {
+	if strings.HasPrefix(name, conf.RegexpPrefix) {
+		re, err := regexp.Compile(strings.TrimPrefix(name, conf.RegexpPrefix))
+		if err != nil {
+			return nil, err
+		}
+		return &pattern{re: re}, nil
+	}
+	return &pattern{suffix: strings.ToLower(strings.TrimPrefix(name, "*"))}, nil
+}
+
+func (p *pattern) matches(host string) bool {
+	if p.re != nil {
+		return p.re.MatchString(host)
+	}
+	return len(host) > len(p.suffix) && strings.HasSuffix(host, p.suffix)
+}
+
+// patterns finds the frontend for names the muxer has no exact match for.
+// Wildcards win over regexes, the longest wildcard wins among them and
+// regexes are tried in the order of their frontend names.
+type patterns struct {
+	wildcards []*pattern
+	regexps   []*pattern
+}
+
+func (ps *patterns) add(p *pattern) {
+	if p.re != nil {
+		ps.regexps = append(ps.regexps, p)
+		sort.Slice(ps.regexps, func(i, j int) bool {
+			return ps.regexps[i].f.Name < ps.regexps[j].f.Name
+		})
+		return
+	}
+	ps.wildcards = append(ps.wildcards, p)
+	sort.Slice(ps.wildcards, func(i, j int) bool {
+		wi, wj := ps.wildcards[i], ps.wildcards[j]
+		if len(wi.suffix) != len(wj.suffix) {
+			return len(wi.suffix) > len(wj.suffix)
+		}
+		return wi.f.Name < wj.f.Name
+	})
+}
+
+func (ps *patterns) remove(f *frontend) {
+	ps.wildcards = removePattern(ps.wildcards, f)
+	ps.regexps = removePattern(ps.regexps, f)
+}
+
+func removePattern(list []*pattern, f *frontend) []*pattern {
+	for i, p := range list {
+		if p.f == f {
+			return append(list[:i], list[i+1:]...)
+		}
+	}
+	return list
+}
+
+// match returns the frontend for the host, nil if none matches. Like the
+// muxer it ignores the port of an HTTP Host.
+func (ps *patterns) match(host string) *frontend {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, p := range ps.wildcards {
+		if p.matches(host) {
+			return p.f
+		}
+	}
+	for _, p := range ps.regexps {
+		if p.matches(host) {
+			return p.f
+		}
+	}
+	return nil
+}
+
+// unmuxedListener is the listener of a frontend the muxer doesn't route
+// to. The server hands it its connections, so Accept only waits for Close.
+type unmuxedListener struct {
+	addr   net.Addr
+	closed chan struct{}
+}
+
+func newUnmuxedListener(addr net.Addr) *unmuxedListener {
+	return &unmuxedListener{addr: addr, closed: make(chan struct{})}
+}
+
+func (l *unmuxedListener) Accept() (net.Conn, error) {
+	<-l.closed
+	return nil, errListenerClosed
+}
+
+func (l *unmuxedListener) Close() error {
+	select {
+	case <-l.closed:
+		return errListenerClosed
+	default:
+		close(l.closed)
+		return nil
+	}
+}
+
+func (l *unmuxedListener) Addr() net.Addr {
+	return l.addr
+}
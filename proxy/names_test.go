@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"testing"
+)
+
+func TestPatterns(t *testing.T) {
+	var ps patterns
+	for _, name := range []string{
+		"*.example.com",
+		"*.tenants.example.com",
+		`~^api-[0-9]+\.example\.com$`,
+		`~^api-`,
+		`~\.org$`,
+	} {
+		p, err := newPattern(name)
+		if err != nil {
+			t.Fatalf("Failed to parse %v: %v", name, err)
+		}
+		p.f = &frontend{Name: name}
+		ps.add(p)
+	}
+
+	for host, expected := range map[string]string{
+		// the longest wildcard wins
+		"a.tenants.example.com":   "*.tenants.example.com",
+		"a.b.tenants.example.com": "*.tenants.example.com",
+		"tenants.example.com":     "*.example.com",
+		// wildcards win over regexes
+		"api-1.example.com": "*.example.com",
+		// regexes are tried in name order
+		"api-1.example.org": `~\.org$`,
+		"api-1.example.net": `~^api-`,
+		"A.Example.COM":     "*.example.com",
+		// the port of an HTTP Host is ignored
+		"a.example.com:8080":   "*.example.com",
+		"api-2.example.org:80": `~\.org$`,
+		"example.com":          "",
+		"other.net":            "",
+	} {
+		got := ""
+		if f := ps.match(host); f != nil {
+			got = f.Name
+		}
+		if got != expected {
+			t.Errorf("Wrong frontend for %v. Got %q, expected %q", host, got, expected)
+		}
+	}
+
+	ps.remove(ps.wildcards[0].f)
+	if f := ps.match("a.tenants.example.com"); f == nil || f.Name != "*.example.com" {
+		t.Errorf("Expected *.example.com after removing *.tenants.example.com, got %v", f)
+	}
+}
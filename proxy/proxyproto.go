@@ -0,0 +1,388 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/acls/goproxy/conf"
+)
+
+// HAProxy PROXY protocol
+// https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyV1MaxLen             = 107
+	proxyV2HeaderLen          = 16
+	proxyV2CmdLocal      byte = 0x20 // version 2, LOCAL command
+	proxyV2CmdProxy      byte = 0x21 // version 2, PROXY command
+	proxyV2FamUnspec     byte = 0x00
+	proxyV2FamTCP4       byte = 0x11
+	proxyV2FamTCP6       byte = 0x21
+	proxyV2TypeAuthority byte = 0x02
+	proxyV2TypeSSL       byte = 0x20
+
+	proxyV2SubtypeSSLVersion byte = 0x21
+	proxyV2SubtypeSSLCN      byte = 0x22
+
+	proxyV2ClientSSL      byte = 0x01
+	proxyV2ClientCertConn byte = 0x02
+)
+
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "TLSv1",
+	tls.VersionTLS11: "TLSv1.1",
+	tls.VersionTLS12: "TLSv1.2",
+	tls.VersionTLS13: "TLSv1.3",
+}
+
+var errNoProxyHeader = errors.New("Missing PROXY protocol header")
+
+// proxyHeader is what a PROXY protocol header tells about a connection
+type proxyHeader struct {
+	Src *net.TCPAddr
+	Dst *net.TCPAddr
+	// Authority is the host name the client asked for, only sent by v2
+	Authority string
+	// TLS is the client's terminated TLS connection, only sent by v2
+	TLS *tls.ConnectionState
+	// Local marks goproxy's own connections like health checks, they're
+	// sent without addresses as v2 LOCAL or v1 UNKNOWN
+	Local bool
+}
+
+func newProxyHeader(c net.Conn, authority string) *proxyHeader {
+	h := &proxyHeader{Authority: authority}
+	src, srcOK := c.RemoteAddr().(*net.TCPAddr)
+	dst, dstOK := c.LocalAddr().(*net.TCPAddr)
+	if srcOK && dstOK {
+		h.Src, h.Dst = src, dst
+	}
+	return h
+}
+
+// ipv4 returns whether both addresses can be sent as IPv4
+func (h *proxyHeader) ipv4() bool {
+	return h.Src.IP.To4() != nil && h.Dst.IP.To4() != nil
+}
+
+// WriteVersion writes the header in the given PROXY protocol version
+func (h *proxyHeader) WriteVersion(w io.Writer, version string) error {
+	switch version {
+	case conf.ProxyProtocolV1:
+		return h.writeV1(w)
+	case conf.ProxyProtocolV2:
+		return h.writeV2(w)
+	}
+	return fmt.Errorf("Unknown PROXY protocol version '%s'", version)
+}
+
+func (h *proxyHeader) writeV1(w io.Writer) error {
+	if h.Src == nil || h.Local {
+		_, err := io.WriteString(w, "PROXY UNKNOWN\r\n")
+		return err
+	}
+	proto, srcIP, dstIP := "TCP6", h.Src.IP.To16(), h.Dst.IP.To16()
+	if h.ipv4() {
+		proto, srcIP, dstIP = "TCP4", h.Src.IP.To4(), h.Dst.IP.To4()
+	}
+	_, err := fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n", proto, srcIP, dstIP, h.Src.Port, h.Dst.Port)
+	return err
+}
+
+func (h *proxyHeader) writeV2(w io.Writer) error {
+	if h.Local {
+		head := append([]byte{}, proxyV2Signature...)
+		head = append(head, proxyV2CmdLocal, proxyV2FamUnspec, 0, 0)
+		_, err := w.Write(head)
+		return err
+	}
+
+	var body bytes.Buffer
+	fam := proxyV2FamUnspec
+	if h.Src != nil {
+		if h.ipv4() {
+			fam = proxyV2FamTCP4
+			body.Write(h.Src.IP.To4())
+			body.Write(h.Dst.IP.To4())
+		} else {
+			fam = proxyV2FamTCP6
+			body.Write(h.Src.IP.To16())
+			body.Write(h.Dst.IP.To16())
+		}
+		binary.Write(&body, binary.BigEndian, uint16(h.Src.Port))
+		binary.Write(&body, binary.BigEndian, uint16(h.Dst.Port))
+	}
+	if h.Authority != "" {
+		writeTLV(&body, proxyV2TypeAuthority, []byte(h.Authority))
+	}
+	if h.TLS != nil {
+		writeTLV(&body, proxyV2TypeSSL, sslTLV(h.TLS))
+	}
+
+	var buf bytes.Buffer
+	buf.Write(proxyV2Signature)
+	buf.WriteByte(proxyV2CmdProxy)
+	buf.WriteByte(fam)
+	binary.Write(&buf, binary.BigEndian, uint16(body.Len()))
+	buf.Write(body.Bytes())
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// sslTLV returns the PP2_TYPE_SSL value for the connection. The client
+// certificate's common name is only sent once it has been verified.
+func sslTLV(state *tls.ConnectionState) []byte {
+	var buf bytes.Buffer
+	client := proxyV2ClientSSL
+	if len(state.PeerCertificates) > 0 {
+		client |= proxyV2ClientCertConn
+	}
+	buf.WriteByte(client)
+	verified := len(state.VerifiedChains) > 0
+	if verified {
+		binary.Write(&buf, binary.BigEndian, uint32(0))
+	} else {
+		binary.Write(&buf, binary.BigEndian, uint32(1))
+	}
+
+	if name, ok := tlsVersionNames[state.Version]; ok {
+		writeTLV(&buf, proxyV2SubtypeSSLVersion, []byte(name))
+	}
+	if verified {
+		writeTLV(&buf, proxyV2SubtypeSSLCN, []byte(state.PeerCertificates[0].Subject.CommonName))
+	}
+	return buf.Bytes()
+}
+
+func writeTLV(buf *bytes.Buffer, typ byte, value []byte) {
+	buf.WriteByte(typ)
+	binary.Write(buf, binary.BigEndian, uint16(len(value)))
+	buf.Write(value)
+}
+
+// readProxyHeader reads a v1 or v2 PROXY protocol header. A nil header
+// without an error means the connection's own addresses should be used.
+func readProxyHeader(r *bufio.Reader) (*proxyHeader, error) {
+	if hasPrefix(r, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	if hasPrefix(r, []byte("PROXY ")) {
+		return readProxyHeaderV1(r)
+	}
+	return nil, errNoProxyHeader
+}
+
+// hasPrefix peeks one byte at a time so it only waits for more data while
+// what the client sent so far still matches
+func hasPrefix(r *bufio.Reader, prefix []byte) bool {
+	for i := range prefix {
+		b, err := r.Peek(i + 1)
+		if err != nil || b[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (*proxyHeader, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLen {
+			return nil, errors.New("PROXY protocol v1 header too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("Invalid PROXY protocol v1 header: %q", line)
+	}
+	src, err := parseProxyAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseProxyAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+	return &proxyHeader{Src: src, Dst: dst}, nil
+}
+
+func parseProxyAddr(ip, port string) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	if addr.IP == nil {
+		return nil, fmt.Errorf("Invalid PROXY protocol address: %q", ip)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid PROXY protocol port: %q", port)
+	}
+	addr.Port = int(p)
+	return addr, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (*proxyHeader, error) {
+	head := make([]byte, proxyV2HeaderLen)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	cmd, fam := head[12], head[13]
+	body := make([]byte, binary.BigEndian.Uint16(head[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch cmd {
+	case proxyV2CmdLocal:
+		// health checks from the load balancer itself
+		return nil, nil
+	case proxyV2CmdProxy:
+	default:
+		return nil, fmt.Errorf("Invalid PROXY protocol v2 command: %#x", cmd)
+	}
+
+	var ipLen int
+	switch fam {
+	case proxyV2FamTCP4:
+		ipLen = net.IPv4len
+	case proxyV2FamTCP6:
+		ipLen = net.IPv6len
+	default:
+		// unsupported address family, use the connection's addresses
+		return nil, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, errors.New("PROXY protocol v2 header too short")
+	}
+	h := &proxyHeader{
+		Src: &net.TCPAddr{
+			IP:   net.IP(body[:ipLen]),
+			Port: int(binary.BigEndian.Uint16(body[2*ipLen:])),
+		},
+		Dst: &net.TCPAddr{
+			IP:   net.IP(body[ipLen : 2*ipLen]),
+			Port: int(binary.BigEndian.Uint16(body[2*ipLen+2:])),
+		},
+	}
+
+	// TLVs
+	for tlvs := body[2*ipLen+4:]; len(tlvs) >= 3; {
+		typ, n := tlvs[0], int(binary.BigEndian.Uint16(tlvs[1:]))
+		if len(tlvs) < 3+n {
+			return nil, errors.New("PROXY protocol v2 TLV too short")
+		}
+		if typ == proxyV2TypeAuthority {
+			h.Authority = string(tlvs[3 : 3+n])
+		}
+		tlvs = tlvs[3+n:]
+	}
+	return h, nil
+}
+
+// proxyProtoListener strips the PROXY protocol header from accepted
+// connections and reports the client's address as their remote address
+type proxyProtoListener struct {
+	net.Listener
+	timeout time.Duration
+}
+
+func newProxyProtoListener(l net.Listener, timeout time.Duration) net.Listener {
+	return &proxyProtoListener{Listener: l, timeout: timeout}
+}
+
+// Accept doesn't wait for the header, it's read on first use of the connection
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtoConn{
+		Conn:    c,
+		r:       bufio.NewReader(c),
+		timeout: l.timeout,
+	}, nil
+}
+
+type proxyProtoConn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+
+	once   sync.Once
+	header *proxyHeader
+	err    error
+
+	deadlineL    sync.Mutex
+	readDeadline time.Time
+}
+
+func (c *proxyProtoConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		c.header, c.err = readProxyHeader(c.r)
+
+		// restore the deadline the user asked for
+		c.deadlineL.Lock()
+		c.Conn.SetReadDeadline(c.readDeadline)
+		c.deadlineL.Unlock()
+	})
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the client's address from the header
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.header == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.header.Src
+}
+
+// LocalAddr returns the address the client connected to from the header
+func (c *proxyProtoConn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.header == nil {
+		return c.Conn.LocalAddr()
+	}
+	return c.header.Dst
+}
+
+func (c *proxyProtoConn) SetDeadline(t time.Time) error {
+	c.deadlineL.Lock()
+	c.readDeadline = t
+	c.deadlineL.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyProtoConn) SetReadDeadline(t time.Time) error {
+	c.deadlineL.Lock()
+	c.readDeadline = t
+	c.deadlineL.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
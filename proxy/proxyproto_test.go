@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/acls/goproxy/conf"
+)
+
+func TestWriteProxyHeaderV1(t *testing.T) {
+	tests := []struct {
+		h        *proxyHeader
+		expected string
+	}{
+		{
+			&proxyHeader{
+				Src: &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 56324},
+				Dst: &net.TCPAddr{IP: net.ParseIP("192.168.0.11"), Port: 443},
+			},
+			"PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n",
+		},
+		{
+			&proxyHeader{
+				Src: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324},
+				Dst: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+			},
+			"PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n",
+		},
+		{
+			&proxyHeader{},
+			"PROXY UNKNOWN\r\n",
+		},
+		{
+			&proxyHeader{
+				Src:   &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 56324},
+				Dst:   &net.TCPAddr{IP: net.ParseIP("192.168.0.11"), Port: 443},
+				Local: true,
+			},
+			"PROXY UNKNOWN\r\n",
+		},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := test.h.WriteVersion(&buf, conf.ProxyProtocolV1); err != nil {
+			t.Fatalf("Failed to write header: %v", err)
+		}
+		if got := buf.String(); got != test.expected {
+			t.Errorf("Wrong header. Got %q, expected %q", got, test.expected)
+		}
+	}
+}
+
+func TestWriteProxyHeaderV2(t *testing.T) {
+	h := &proxyHeader{
+		Src:       &net.TCPAddr{IP: net.ParseIP("192.168.0.1"), Port: 0x1234},
+		Dst:       &net.TCPAddr{IP: net.ParseIP("192.168.0.11"), Port: 443},
+		Authority: "test.example.com",
+	}
+	var buf bytes.Buffer
+	if err := h.WriteVersion(&buf, conf.ProxyProtocolV2); err != nil {
+		t.Fatalf("Failed to write header: %v", err)
+	}
+
+	expected := append([]byte("\r\n\r\n\x00\r\nQUIT\n"),
+		0x21, 0x11, 0x00, 12+3+16,
+		192, 168, 0, 1,
+		192, 168, 0, 11,
+		0x12, 0x34,
+		0x01, 0xbb,
+		0x02, 0x00, 16,
+	)
+	expected = append(expected, "test.example.com"...)
+	if got := buf.Bytes(); !bytes.Equal(got, expected) {
+		t.Errorf("Wrong header. Got %v, expected %v", got, expected)
+	}
+
+	// LOCAL headers have no addresses or TLVs
+	h.Local = true
+	buf.Reset()
+	if err := h.WriteVersion(&buf, conf.ProxyProtocolV2); err != nil {
+		t.Fatalf("Failed to write header: %v", err)
+	}
+	expected = append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x20, 0x00, 0x00, 0x00)
+	if got := buf.Bytes(); !bytes.Equal(got, expected) {
+		t.Errorf("Wrong LOCAL header. Got %v, expected %v", got, expected)
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}
+
+	for _, version := range []string{conf.ProxyProtocolV1, conf.ProxyProtocolV2} {
+		var buf bytes.Buffer
+		h := &proxyHeader{Src: src, Dst: dst}
+		if version == conf.ProxyProtocolV2 {
+			h.Authority = "test.example.com"
+		}
+		if err := h.WriteVersion(&buf, version); err != nil {
+			t.Fatalf("Failed to write header: %v", err)
+		}
+		buf.WriteString("payload")
+
+		r := bufio.NewReader(&buf)
+		got, err := readProxyHeader(r)
+		if err != nil {
+			t.Fatalf("%s: Failed to read header: %v", version, err)
+		}
+		if !reflect.DeepEqual(got, h) {
+			t.Errorf("%s: Wrong header. Got %+v, expected %+v", version, got, h)
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != "payload" {
+			t.Errorf("%s: Expected the header to be stripped, got %q", version, rest)
+		}
+	}
+
+	for _, input := range []string{
+		"PROXY UNKNOWN\r\npayload",
+		"\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00payload",
+	} {
+		r := bufio.NewReader(bytes.NewBufferString(input))
+		if h, err := readProxyHeader(r); h != nil || err != nil {
+			t.Errorf("Expected no header and no error for %q, got %v %v", input, h, err)
+		}
+	}
+
+	for _, input := range []string{
+		"GET / HTTP/1.1\r\n",
+		"PROXY TCP4 1.2.3.4 5.6.7.8 80\r\n",
+		"PROXY TCP4 1.2.3.4 5.6.7.8 80 999999\r\n",
+		"PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n",
+	} {
+		r := bufio.NewReader(bytes.NewBufferString(input))
+		if _, err := readProxyHeader(r); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestReadProxyHeaderWithoutPayload(t *testing.T) {
+	for _, input := range []string{
+		"PROXY UNKNOWN\r\n",
+		"\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00",
+		"GET",
+	} {
+		client, server := net.Pipe()
+		// the client waits for the reply, the header has to be read without
+		// waiting for more data
+		go client.Write([]byte(input))
+		done := make(chan struct{})
+		go func() {
+			readProxyHeader(bufio.NewReader(server))
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Errorf("Timed out reading %q", input)
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestWriteProxyHeaderV2SSL(t *testing.T) {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "client.example.com"}}
+	h := &proxyHeader{
+		TLS: &tls.ConnectionState{
+			Version:          tls.VersionTLS12,
+			PeerCertificates: []*x509.Certificate{cert},
+			VerifiedChains:   [][]*x509.Certificate{{cert}},
+		},
+	}
+	var buf bytes.Buffer
+	if err := h.WriteVersion(&buf, conf.ProxyProtocolV2); err != nil {
+		t.Fatalf("Failed to write header: %v", err)
+	}
+
+	expected := append([]byte("\r\n\r\n\x00\r\nQUIT\n"),
+		0x21, 0x00, 0x00, 3+5+3+7+3+18,
+		0x20, 0x00, 5+3+7+3+18,
+		0x03, 0x00, 0x00, 0x00, 0x00,
+		0x21, 0x00, 7,
+	)
+	expected = append(expected, "TLSv1.2"...)
+	expected = append(expected, 0x22, 0x00, 18)
+	expected = append(expected, "client.example.com"...)
+	if got := buf.Bytes(); !bytes.Equal(got, expected) {
+		t.Errorf("Wrong header. Got %v, expected %v", got, expected)
+	}
+
+	// unverified client certificates don't have their name sent
+	h.TLS.VerifiedChains = nil
+	buf.Reset()
+	h.WriteVersion(&buf, conf.ProxyProtocolV2)
+	if bytes.Contains(buf.Bytes(), []byte("client.example.com")) {
+		t.Errorf("Expected no common name for an unverified certificate")
+	}
+}
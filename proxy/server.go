@@ -2,20 +2,54 @@ package proxy
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	vhost "github.com/acls/go-vhost"
 	"github.com/acls/goproxy/conf"
 	"go.uber.org/zap"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 const (
-	muxTimeout = 10 * time.Second
+	muxTimeout    = 10 * time.Second
+	drainInterval = 100 * time.Millisecond
 )
 
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	conf.ClientAuthNone:    tls.NoClientCert,
+	conf.ClientAuthRequest: tls.RequestClientCert,
+	conf.ClientAuthRequire: tls.RequireAnyClientCert,
+	conf.ClientAuthVerify:  tls.RequireAndVerifyClientCert,
+}
+
+// setClientAuth makes the TLS config ask for client certificates
+func setClientAuth(cfg *tls.Config, front *conf.Frontend) error {
+	cfg.ClientAuth = clientAuthTypes[front.ClientAuth]
+	if front.ClientCA == "" {
+		return nil
+	}
+
+	pem, err := ioutil.ReadFile(front.ClientCA)
+	if err != nil {
+		return err
+	}
+	cfg.ClientCAs = x509.NewCertPool()
+	if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("No certificates found in '%s'", front.ClientCA)
+	}
+	return nil
+}
+
 var loadTLSConfig = func(crtPath, keyPath string) (*tls.Config, error) {
 	cert, err := tls.LoadX509KeyPair(crtPath, keyPath)
 	if err != nil {
@@ -32,15 +66,38 @@ type Server struct {
 	Name string
 	*zap.Logger
 	*conf.Binding
+	// Watcher reloads certificate files when they change, optional
+	Watcher FileWatcher
+	// Listener is used instead of listening on the bind address, optional.
+	// It's set to the listener Run binds otherwise.
+	Listener net.Listener
+	// PacketConn is the same as Listener for udp bindings
+	PacketConn net.PacketConn
 
 	frontendsL sync.Mutex
 	frontends  map[string]*frontend
-
-	stop chan struct{}
+	// wildcard and regex frontends, tried for names without an exact match
+	patterns patterns
+	// gets the connections for unknown names, optional
+	defaultFrontend *frontend
+
+	// lazily created for the first frontend with autocert
+	certManager *autocert.Manager
+	// the binding's max connections, shared by its frontends
+	limit *limiter
+
+	running  int32
+	stop     chan struct{}
+	stopOnce sync.Once
+	// proxied connections, including those of removed frontends
+	sessions int64
+	// the proxied connections, for Close
+	conns connSet
 
 	// these are for easier testing
 	mux   muxer
 	ready chan struct{}
+	done  chan struct{}
 }
 type muxer interface {
 	Listen(name string) (net.Listener, error)
@@ -53,6 +110,12 @@ func (s *Server) Init() {
 	if s.ready == nil {
 		s.ready = make(chan struct{})
 	}
+	if s.stop == nil {
+		s.stop = make(chan struct{})
+	}
+	if s.done == nil {
+		s.done = make(chan struct{})
+	}
 }
 
 // Ready func
@@ -60,27 +123,73 @@ func (s *Server) Ready() <-chan struct{} {
 	return s.ready
 }
 
+// Done is closed once Run returns
+func (s *Server) Done() <-chan struct{} {
+	return s.done
+}
+
 // Run starts the server
 func (s *Server) Run() error {
 	if s.ready == nil {
 		return fmt.Errorf("%s must call init", s.Name)
 	}
-	if s.stop != nil {
+	if !atomic.CompareAndSwapInt32(&s.running, 0, 1) {
 		return fmt.Errorf("%s already running", s.Name)
 	}
-	s.stop = make(chan struct{})
+	defer close(s.done)
 
-	// bind to port
-	l, err := net.Listen("tcp", s.BindAddr)
-	if err != nil {
-		return err
+	// the binding is replaced by UpdateBinding
+	bindAddr := s.BindAddr
+	s.limit = newLimiter(s.MaxConnections, s.QueueSize, time.Duration(s.QueueTimeout)*time.Millisecond)
+
+	if s.Mode == conf.ModeUDP {
+		return s.runUDP(bindAddr)
+	}
+
+	// bind to port, unless the listener was passed to us
+	l := s.Listener
+	if l == nil {
+		var err error
+		if l, err = net.Listen("tcp", bindAddr); err != nil {
+			return err
+		}
+		s.Listener = l
 	}
 	s.Info("Serving connections", zap.String("addr", l.Addr().String()))
 
-	// start muxing on port
-	if s.Secure {
+	// strip PROXY protocol headers before the muxer looks for a name
+	if s.ProxyProtocol {
+		l = newProxyProtoListener(l, muxTimeout)
+	}
+
+	// close the connections of denied clients and then of those over their
+	// limits before they're read, denied ones don't count toward the limits
+	var checks []connCheck
+	if len(s.Allow) > 0 || len(s.Deny) > 0 {
+		a, err := newACL(s.Allow, s.Deny)
+		if err != nil {
+			return err
+		}
+		checks = append(checks, (&aclCheck{Logger: s.Logger, acl: a, bindAddr: bindAddr}).check)
+	}
+	if s.ClientLimits != nil {
+		limiter, err := newClientLimiter(s.ClientLimits)
+		if err != nil {
+			return err
+		}
+		checks = append(checks, (&clientLimitCheck{Logger: s.Logger, limiter: limiter, bindAddr: bindAddr}).check)
+	}
+	if len(checks) > 0 {
+		l = newCheckListener(l, checks...)
+	}
+
+	// start muxing on port, tcp bindings have no name to mux on
+	var err error
+	switch {
+	case s.Mode == conf.ModeTCP:
+	case s.Secure:
 		s.mux, err = vhost.NewTLSMuxer(l, muxTimeout)
-	} else {
+	default:
 		s.mux, err = vhost.NewHTTPMuxer(l, muxTimeout)
 	}
 	if err != nil {
@@ -88,8 +197,30 @@ func (s *Server) Run() error {
 	}
 
 	defer s.RemoveFrontends()
+	s.addFrontends()
+
+	if s.mux != nil {
+		go s.handleMuxErrors(bindAddr)
+	} else {
+		go s.serveTCP(l)
+	}
+
+	// signal we're ready
+	close(s.ready)
+
+	<-s.stop
+	s.Info("Stopped accepting connections", zap.String("addr", bindAddr))
+	if s.mux != nil {
+		s.mux.Close()
+	} else {
+		l.Close()
+	}
+
+	return nil
+}
 
-	// setup muxing for each frontend
+// addFrontends sets up muxing for each frontend of the binding
+func (s *Server) addFrontends() {
 	for _, front := range s.Frontends {
 		if err := s.AddFrontend(front); err != nil {
 			s.Warn("Failed to add frontend",
@@ -102,58 +233,236 @@ func (s *Server) Run() error {
 			zap.String("name", front.Name),
 		)
 	}
+}
 
-	// custom error handler so we can log errors
-	go func() {
-		for {
-			conn, err := s.mux.NextError()
-
-			switch err.(type) {
-			case vhost.BadRequest:
-				s.Error("got a bad request!", zap.Error(err))
-				conn.Write([]byte("bad request"))
-			case vhost.NotFound:
-				s.Error("got a connection for an unknown vhost", zap.Error(err))
-				conn.Write([]byte("vhost not found"))
-			case vhost.Closed:
+// handleMuxErrors is a custom error handler so we can log errors, and
+// route the names the muxer doesn't know. It returns once the muxer stops
+// accepting, the muxer sends no more errors after that.
+func (s *Server) handleMuxErrors(bindAddr string) {
+	for {
+		conn, err := s.mux.NextError()
+
+		switch err.(type) {
+		case nil:
+			// the error channel was closed
+			return
+		case vhost.BadRequest:
+			muxErrors.WithLabelValues(bindAddr, "bad_request").Inc()
+			s.Error("got a bad request!",
+				zap.String("from", conn.RemoteAddr().String()),
+				zap.Error(err),
+			)
+			conn.Write([]byte("bad request"))
+		case vhost.NotFound:
+			if f := s.matchFrontend(connHost(conn)); f != nil {
+				// the muxer's deadline is only cleared for routed connections
+				conn.SetDeadline(time.Time{})
+				s.handOff(f, conn)
+				continue
+			}
+			muxErrors.WithLabelValues(bindAddr, "not_found").Inc()
+			s.Error("got a connection for an unknown vhost",
+				zap.String("from", conn.RemoteAddr().String()),
+				zap.Error(err),
+			)
+			conn.Write([]byte("vhost not found"))
+		case vhost.Closed:
+			if !s.stopping() {
 				s.Error("closed conn", zap.Error(err))
-			default:
-				if conn != nil {
-					conn.Write([]byte("server error"))
-				}
 			}
-
 			if conn != nil {
 				conn.Close()
 			}
+			return
+		default:
+			muxErrors.WithLabelValues(bindAddr, "other").Inc()
+			if conn != nil {
+				conn.Write([]byte("server error"))
+			}
 		}
-	}()
 
-	// signal we're ready
-	close(s.ready)
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
 
-	<-s.stop
-	s.stop = nil
+// serveTCP hands every connection to the binding's frontend
+func (s *Server) serveTCP(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.stopping() {
+				return
+			}
+			s.Error("Failed to accept new connection", zap.Error(err))
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				continue
+			}
+			return
+		}
 
-	return nil
+		if f := s.matchFrontend(""); f != nil {
+			s.handOff(f, conn)
+		} else {
+			conn.Close()
+		}
+	}
 }
 
-// Stop stops the server
+// handOff proxies a connection the server accepted for the frontend
+func (s *Server) handOff(f *frontend, conn net.Conn) {
+	if f.denied(conn) {
+		return
+	}
+	f.Debug("Accepted new connection",
+		zap.String("name", f.Name),
+		zap.String("host", connHost(conn)),
+		zap.String("from", conn.RemoteAddr().String()),
+	)
+	acceptedConnections.WithLabelValues(f.BoundAddr, f.Name).Inc()
+	go f.proxyConnection(conn)
+}
+
+// Stop closes the listener and the frontends, connections that are already
+// proxied carry on until they finish or Drain gives up on them
 func (s *Server) Stop() {
-	if s.stop != nil {
+	s.stopOnce.Do(func() {
 		close(s.stop)
+	})
+}
+
+func (s *Server) stopping() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Sessions returns the number of proxied connections
+func (s *Server) Sessions() int64 {
+	return atomic.LoadInt64(&s.sessions)
+}
+
+// Drain waits for the proxied connections to finish, it returns false if
+// some are still open after the timeout
+func (s *Server) Drain(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for s.Sessions() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(drainInterval)
+	}
+	return true
+}
+
+// Close closes the proxied connections, for those that didn't finish
+// draining
+func (s *Server) Close() {
+	s.conns.closeAll()
+}
+
+// connSet is a set of connections that can be closed at once
+type connSet struct {
+	sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func (cs *connSet) add(c net.Conn) {
+	cs.Lock()
+	defer cs.Unlock()
+	if cs.conns == nil {
+		cs.conns = make(map[net.Conn]struct{})
 	}
+	cs.conns[c] = struct{}{}
 }
 
-// ReplaceFrontend replaces the frontend
+func (cs *connSet) remove(c net.Conn) {
+	cs.Lock()
+	defer cs.Unlock()
+	delete(cs.conns, c)
+}
+
+func (cs *connSet) closeAll() {
+	cs.Lock()
+	defer cs.Unlock()
+	for c := range cs.conns {
+		c.Close()
+	}
+}
+
+// UpdateBinding applies a new configuration of the server's binding.
+// Frontends that were added, changed or removed in it are added, replaced
+// or removed, others like those of watched files are left alone. It
+// returns false without changing anything if the binding's own settings
+// changed, which needs a new server.
+func (s *Server) UpdateBinding(binding *conf.Binding) (bool, error) {
+	s.frontendsL.Lock()
+	defer s.frontendsL.Unlock()
+
+	old := *s.Binding
+	next := *binding
+	old.Frontends, next.Frontends = nil, nil
+	old.Frontend, next.Frontend = nil, nil
+	if !reflect.DeepEqual(old, next) {
+		return false, nil
+	}
+
+	var errs []string
+	for name, front := range binding.Frontends {
+		prev, ok := s.Frontends[name]
+		if ok && reflect.DeepEqual(prev, front) {
+			continue
+		}
+		if err := s.replaceFrontend(front); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		s.Info("Updated frontend", zap.String("name", name))
+	}
+	for name := range s.Frontends {
+		if _, ok := binding.Frontends[name]; ok {
+			continue
+		}
+		if f, ok := s.frontends[name]; ok {
+			s.removeFrontend(f)
+			s.Info("Removed frontend", zap.String("name", name))
+		}
+	}
+	s.Binding = binding
+
+	if len(errs) > 0 {
+		return true, errors.New(strings.Join(errs, "; "))
+	}
+	return true, nil
+}
+
+// ReplaceFrontend replaces the frontend, the previous one is restored if
+// the new one can't be added
 func (s *Server) ReplaceFrontend(front *conf.Frontend) error {
 	s.frontendsL.Lock()
 	defer s.frontendsL.Unlock()
 
-	if f, ok := s.frontends[front.Name]; ok {
-		s.removeFrontend(f)
+	return s.replaceFrontend(front)
+}
+func (s *Server) replaceFrontend(front *conf.Frontend) error {
+	old, ok := s.frontends[front.Name]
+	if ok {
+		s.removeFrontend(old)
 	}
-	return s.addFrontend(front)
+	err := s.addFrontend(front)
+	if err != nil && ok {
+		if restoreErr := s.addFrontend(old.config); restoreErr != nil {
+			s.Error("Failed to restore frontend",
+				zap.String("name", old.Name),
+				zap.Error(restoreErr),
+			)
+		}
+	}
+	return err
 }
 
 // AddFrontend adds the frontend
@@ -172,31 +481,131 @@ func (s *Server) addFrontend(front *conf.Frontend) error {
 	if ok {
 		return fmt.Errorf("Frontend %s already exists", front.Name)
 	}
+	if s.SingleFrontend() && len(s.frontends) > 0 {
+		return fmt.Errorf("%s: A %s binding only has one frontend", s.Name, s.Mode)
+	}
+	if s.Mode == conf.ModeUDP {
+		if err := front.ValidateUDP(); err != nil {
+			return err
+		}
+	}
+	if front.Default && s.defaultFrontend != nil {
+		return fmt.Errorf("%s: Only one frontend may be the default, '%v' already is", s.Name, s.defaultFrontend.Name)
+	}
+
+	backends := newBackends(front.Backends)
+	for _, b := range backends {
+		if err := b.loadTLSConfig(); err != nil {
+			return fmt.Errorf("%s: Failed to load TLS configuration for backend '%v' on frontend '%v': %v", s.Name, b.Addr, front.Name, err)
+		}
+	}
+	strategy, err := newStrategy(front.Strategy, backends)
+	if err != nil {
+		return fmt.Errorf("%s: Failed to create strategy for frontend '%v': %v", s.Name, front.Name, err)
+	}
+	frontACL, err := newACL(front.Allow, front.Deny)
+	if err != nil {
+		return fmt.Errorf("%s: Invalid allow or deny for frontend '%v': %v", s.Name, front.Name, err)
+	}
 
 	var tlsConfig *tls.Config
+	var unwatch func()
 	if front.TLSCrt != "" || front.TLSKey != "" {
-		var err error
-		if tlsConfig, err = loadTLSConfig(front.TLSCrt, front.TLSKey); err != nil {
+		certs, err := newCertReloader(s.Logger, front.Name, front.TLSCrt, front.TLSKey)
+		if err != nil {
 			err = fmt.Errorf("%s: Failed to load TLS configuration for frontend '%v': %v", s.Name, front.Name, err)
 			return err
 		}
+		if s.Watcher != nil {
+			if unwatch, err = s.Watcher.WatchFiles(certs.Reload, front.TLSCrt, front.TLSKey); err != nil {
+				s.Warn("Failed to watch TLS certificate files",
+					zap.String("frontend", front.Name),
+					zap.Error(err),
+				)
+			}
+		}
+		tlsConfig = &tls.Config{GetCertificate: certs.GetCertificate}
+	} else if front.Autocert {
+		if s.certManager == nil {
+			if s.certManager, err = s.newCertManager(); err != nil {
+				return fmt.Errorf("%s: Failed to create ACME certificate manager: %v", s.Name, err)
+			}
+		}
+		tlsConfig = autocertTLSConfig(s.certManager)
+	}
+	if tlsConfig != nil && front.ClientAuth != "" {
+		if err := setClientAuth(tlsConfig, front); err != nil {
+			if unwatch != nil {
+				unwatch()
+			}
+			return fmt.Errorf("%s: Failed to load client CA for frontend '%v': %v", s.Name, front.Name, err)
+		}
 	}
 
-	l, err := s.mux.Listen(front.Name)
+	// the muxer only knows exact names, the others are matched by the server
+	var l net.Listener
+	var p *pattern
+	if s.Mode == conf.ModeUDP {
+		l = newUnmuxedListener(s.PacketConn.LocalAddr())
+	} else if s.Mode == conf.ModeTCP {
+		l = newUnmuxedListener(s.Listener.Addr())
+	} else if isPattern(front.Name) {
+		if p, err = newPattern(front.Name); err == nil {
+			l = newUnmuxedListener(s.Listener.Addr())
+		}
+	} else {
+		l, err = s.mux.Listen(front.Name)
+	}
 	if err != nil {
+		if unwatch != nil {
+			unwatch()
+		}
 		return err
 	}
 
 	f = &frontend{
-		Name:      front.Name,
-		BoundAddr: front.BoundAddr,
-		Logger:    s.Logger,
-		TLSConfig: tlsConfig,
-		Listener:  l,
-		// always round-robin strategy for now
-		Strategy: &RoundRobinStrategy{backends: front.Backends},
+		Name:         front.Name,
+		BoundAddr:    front.BoundAddr,
+		Logger:       s.Logger,
+		TLSConfig:    tlsConfig,
+		Autocert:     front.Autocert,
+		Listener:     l,
+		Strategy:     strategy,
+		unwatch:      unwatch,
+		config:       front,
+		backends:     backends,
+		sessions:     &s.sessions,
+		conns:        &s.conns,
+		limit:        newLimiter(front.MaxConnections, front.QueueSize, time.Duration(front.QueueTimeout)*time.Millisecond),
+		bindingLimit: s.limit,
+		acl:          frontACL,
+
+		Retries:     front.Retries,
+		MaxFails:    front.MaxFails,
+		FailTimeout: time.Duration(front.FailTimeout) * time.Millisecond,
+
+		IdleTimeout:           time.Duration(front.IdleTimeout) * time.Millisecond,
+		MaxConnectionDuration: time.Duration(front.MaxConnectionDuration) * time.Millisecond,
+		HalfCloseTimeout:      time.Duration(front.HalfCloseTimeout) * time.Millisecond,
+		HandshakeTimeout:      time.Duration(front.HandshakeTimeout) * time.Millisecond,
+	}
+	for _, b := range backends {
+		if b.HealthCheck != nil {
+			f.checkers = append(f.checkers, newHealthChecker(s.Logger, f.Name, b))
+		}
 	}
 	s.frontends[f.Name] = f
+	if p != nil {
+		p.f = f
+		s.patterns.add(p)
+	}
+	if s.Mode == conf.ModeUDP {
+		f.Network = "udp"
+	}
+	// a tcp or udp binding's frontend gets every connection
+	if front.Default || s.SingleFrontend() {
+		s.defaultFrontend = f
+	}
 
 	go f.Run()
 	return nil
@@ -213,7 +622,7 @@ func (s *Server) RemoveFrontend(name string) {
 
 	f, ok := s.frontends[name]
 	if !ok {
-		f.Warn("Frontend doesn't exist",
+		s.Warn("Frontend doesn't exist",
 			zap.String("name", name),
 		)
 	} else {
@@ -230,8 +639,24 @@ func (s *Server) RemoveFrontends() {
 	}
 }
 
+// matchFrontend returns the frontend for a name without an exact match,
+// the default frontend if no wildcard or regex matches it
+func (s *Server) matchFrontend(host string) *frontend {
+	s.frontendsL.Lock()
+	defer s.frontendsL.Unlock()
+
+	if f := s.patterns.match(host); f != nil {
+		return f
+	}
+	return s.defaultFrontend
+}
+
 func (s *Server) removeFrontend(f *frontend) {
 	delete(s.frontends, f.Name)
+	s.patterns.remove(f)
+	if s.defaultFrontend == f {
+		s.defaultFrontend = nil
+	}
 	if err := f.Stop(); err != nil {
 		s.Warn("Stop frontend connection error",
 			zap.String("name", f.Name),
@@ -239,3 +664,64 @@ func (s *Server) removeFrontend(f *frontend) {
 		)
 	}
 }
+
+// ServerStatus is a server and the live state of its frontends
+type ServerStatus struct {
+	Name      string           `json:"name"`
+	BindAddr  string           `json:"bindAddr"`
+	Secure    bool             `json:"secure"`
+	Mode      string           `json:"mode"`
+	Watch     bool             `json:"watch"`
+	Frontends []FrontendStatus `json:"frontends"`
+}
+
+// FrontendStatus is a frontend's configuration and its backends' state
+type FrontendStatus struct {
+	Name     string          `json:"name"`
+	Config   *conf.Frontend  `json:"config"`
+	Backends []BackendStatus `json:"backends"`
+}
+
+// BackendStatus is a backend's live state
+type BackendStatus struct {
+	Addr    string `json:"addr"`
+	Weight  int    `json:"weight"`
+	Healthy bool   `json:"healthy"`
+	Ejected bool   `json:"ejected"`
+	// Active is the number of proxied connections
+	Active int `json:"active"`
+}
+
+// Status returns the server's frontends sorted by name
+func (s *Server) Status() ServerStatus {
+	s.frontendsL.Lock()
+	defer s.frontendsL.Unlock()
+
+	status := ServerStatus{
+		Name:      s.Name,
+		BindAddr:  s.BindAddr,
+		Secure:    s.Secure,
+		Mode:      s.Mode,
+		Watch:     s.Watch,
+		Frontends: []FrontendStatus{},
+	}
+	for _, f := range s.frontends {
+		status.Frontends = append(status.Frontends, f.status())
+	}
+	sort.Slice(status.Frontends, func(i, j int) bool {
+		return status.Frontends[i].Name < status.Frontends[j].Name
+	})
+	return status
+}
+
+// FrontendStatus returns the named frontend's status
+func (s *Server) FrontendStatus(name string) (FrontendStatus, bool) {
+	s.frontendsL.Lock()
+	defer s.frontendsL.Unlock()
+
+	f, ok := s.frontends[name]
+	if !ok {
+		return FrontendStatus{}, false
+	}
+	return f.status(), true
+}
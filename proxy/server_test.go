@@ -1,14 +1,28 @@
 package proxy
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/big"
 	"net"
+	"os"
 	"reflect"
 	"testing"
+	"time"
 
+	vhost "github.com/acls/go-vhost"
 	"github.com/acls/goproxy/conf"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"go.uber.org/zap"
 )
 
@@ -241,6 +255,233 @@ func TestHostNotFound(t *testing.T) {
 	}
 }
 
+func TestMuxErrorsStop(t *testing.T) {
+	s := mkServer(t, &conf.Binding{BindAddr: bindAddr})
+	l, err := net.Listen("tcp", bindAddr)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	if s.mux, err = vhost.NewHTTPMuxer(l, muxTimeout); err != nil {
+		t.Fatalf("Failed to create muxer: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.handleMuxErrors(bindAddr)
+		close(done)
+	}()
+
+	// the handler returns once the muxer stops accepting
+	s.mux.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Errorf("Expected the mux error handler to return")
+	}
+}
+
+func TestDefaultFrontend(t *testing.T) {
+	_, addr := backendOrFail(t)
+	l, defaultAddr := backendOrFail(t)
+
+	s := mkServer(t, &conf.Binding{
+		Secure:   true,
+		BindAddr: bindAddr,
+		Frontends: map[string]*conf.Frontend{
+			"test.example.com": &conf.Frontend{
+				BoundAddr: bindAddr,
+				Name:      "test.example.com",
+				Backends: []conf.Backend{
+					conf.Backend{
+						Addr: addr,
+					},
+				},
+			},
+			"fallback": &conf.Frontend{
+				BoundAddr: bindAddr,
+				Name:      "fallback",
+				Default:   true,
+				Backends: []conf.Backend{
+					conf.Backend{
+						Addr: defaultAddr,
+					},
+				},
+			},
+		},
+	})
+
+	go s.Run()
+	<-s.Ready()
+	defer s.mux.Close()
+
+	if err := s.AddFrontend(&conf.Frontend{
+		BoundAddr: bindAddr,
+		Name:      "other",
+		Default:   true,
+		Backends:  []conf.Backend{conf.Backend{Addr: addr}},
+	}); err == nil {
+		t.Errorf("Expected error when adding a second default frontend, got nil")
+	}
+
+	expected := []byte("Hello World")
+	go func() {
+		out, err := tls.Dial("tcp", bindAddr, &tls.Config{ServerName: "foo.example.com", InsecureSkipVerify: true})
+		if err != nil {
+			t.Errorf("Failed to dial: %v", err)
+			return
+		}
+		out.Write(expected)
+		out.Close()
+	}()
+
+	in, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept new connection: %v", err)
+	}
+	got, err := ioutil.ReadAll(in)
+	if err != nil {
+		t.Fatalf("Error reading data from connection: %v", err)
+	}
+	in.Close()
+
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Wrong data read from connection. Got %v, expected %v", got, expected)
+	}
+}
+
+func TestPatternFrontends(t *testing.T) {
+	exactL, exactAddr := backendOrFail(t)
+	wildcardL, wildcardAddr := backendOrFail(t)
+	regexL, regexAddr := backendOrFail(t)
+
+	frontends := map[string]*conf.Frontend{}
+	for name, addr := range map[string]string{
+		"api-1.example.com":           exactAddr,
+		"*.example.com":               wildcardAddr,
+		`~^api-[0-9]+\.example\.net$`: regexAddr,
+	} {
+		frontends[name] = &conf.Frontend{
+			BoundAddr: bindAddr,
+			Name:      name,
+			Backends: []conf.Backend{
+				conf.Backend{
+					Addr: addr,
+				},
+			},
+		}
+	}
+	s := mkServer(t, &conf.Binding{
+		Secure:    true,
+		BindAddr:  bindAddr,
+		Frontends: frontends,
+	})
+
+	go s.Run()
+	<-s.Ready()
+	defer s.mux.Close()
+
+	for _, tc := range []struct {
+		name string
+		l    net.Listener
+	}{
+		{"api-1.example.com", exactL},
+		{"api-2.example.com", wildcardL},
+		{"a.b.example.com", wildcardL},
+		{"api-2.example.net", regexL},
+	} {
+		expected := []byte(tc.name)
+		go func(name string) {
+			out, err := tls.Dial("tcp", bindAddr, &tls.Config{ServerName: name, InsecureSkipVerify: true})
+			if err != nil {
+				t.Errorf("Failed to dial %v: %v", name, err)
+				return
+			}
+			out.Write(expected)
+			out.Close()
+		}(tc.name)
+
+		in, err := tc.l.Accept()
+		if err != nil {
+			t.Fatalf("Failed to accept new connection: %v", err)
+		}
+		got, err := ioutil.ReadAll(in)
+		if err != nil {
+			t.Fatalf("Error reading data from connection: %v", err)
+		}
+		in.Close()
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("Wrong backend for %v. Got %s", tc.name, got)
+		}
+	}
+
+	if _, err := tls.Dial("tcp", bindAddr, &tls.Config{ServerName: "api-1.example.org", InsecureSkipVerify: true}); err == nil {
+		t.Errorf("Expected error when dialing a name nothing matches, got nil")
+	}
+}
+
+func TestTCPMode(t *testing.T) {
+	l, addr := backendOrFail(t)
+
+	front := &conf.Frontend{
+		BoundAddr: bindAddr,
+		Name:      bindAddr,
+		Backends: []conf.Backend{
+			conf.Backend{
+				Addr: addr,
+			},
+		},
+	}
+	s := mkServer(t, &conf.Binding{
+		Mode:     conf.ModeTCP,
+		BindAddr: bindAddr,
+		Frontend: front,
+		Frontends: map[string]*conf.Frontend{
+			front.Name: front,
+		},
+	})
+
+	go s.Run()
+	<-s.Ready()
+	defer func() {
+		s.Stop()
+		<-s.Done()
+	}()
+
+	if err := s.AddFrontend(&conf.Frontend{
+		BoundAddr: bindAddr,
+		Name:      "test.example.com",
+		Backends:  []conf.Backend{conf.Backend{Addr: addr}},
+	}); err == nil {
+		t.Errorf("Expected error when adding a second frontend to a tcp binding, got nil")
+	}
+
+	// nothing is inspected, so it works without SNI
+	expected := []byte("Hello World")
+	go func() {
+		out, err := tls.Dial("tcp", bindAddr, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Errorf("Failed to dial: %v", err)
+			return
+		}
+		out.Write(expected)
+		out.Close()
+	}()
+
+	in, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept new connection: %v", err)
+	}
+	got, err := ioutil.ReadAll(in)
+	if err != nil {
+		t.Fatalf("Error reading data from connection: %v", err)
+	}
+	in.Close()
+
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Wrong data read from connection. Got %v, expected %v", got, expected)
+	}
+}
+
 func TestRoundRobin(t *testing.T) {
 	l1, addr1 := backendOrFail(t)
 	l2, addr2 := backendOrFail(t)
@@ -379,3 +620,1006 @@ func TestTerminateTLS(t *testing.T) {
 		t.Errorf("Wrong data read from connection. Got %v, expected %v", got, expected)
 	}
 }
+
+func TestRetry(t *testing.T) {
+	l, addr := backendOrFail(t)
+
+	// nothing listens on the closed backend's address
+	closed, closedAddr := backendOrFail(t)
+	closed.Close()
+
+	s := mkServer(t, &conf.Binding{
+		Secure:   true,
+		BindAddr: bindAddr,
+		Frontends: map[string]*conf.Frontend{
+			"test.example.com": &conf.Frontend{
+				BoundAddr:   bindAddr,
+				Name:        "test.example.com",
+				Retries:     1,
+				MaxFails:    1,
+				FailTimeout: 60000,
+				Backends: []conf.Backend{
+					conf.Backend{
+						Addr: addr,
+					},
+					// round robin tries the second backend first
+					conf.Backend{
+						Addr: closedAddr,
+					},
+				},
+			},
+		},
+	})
+
+	go s.Run()
+	// wait for the listener to bind
+	<-s.Ready()
+	defer s.mux.Close()
+
+	expected := []byte("Hello World")
+	go func() {
+		out, err := tls.Dial("tcp", bindAddr, &tls.Config{ServerName: "test.example.com", InsecureSkipVerify: true})
+		if err != nil {
+			t.Errorf("Failed to dial: %v", err)
+			return
+		}
+		out.Write(expected)
+		out.Close()
+	}()
+
+	in, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept new connection: %v", err)
+	}
+
+	got, err := ioutil.ReadAll(in)
+	if err != nil {
+		t.Fatalf("Error reading data from connection: %v", err)
+	}
+
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Wrong data read from connection. Got %v, expected %v", got, expected)
+	}
+
+	// the failed backend was ejected
+	for _, b := range s.frontends["test.example.com"].Strategy.(*RoundRobinStrategy).backends {
+		if b.Addr == closedAddr && b.available() {
+			t.Errorf("Expected backend %v to be ejected", closedAddr)
+		}
+	}
+}
+
+func TestSendProxyProtocol(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	s := mkServer(t, &conf.Binding{
+		Secure:   true,
+		BindAddr: bindAddr,
+		Frontends: map[string]*conf.Frontend{
+			"test.example.com": &conf.Frontend{
+				BoundAddr: bindAddr,
+				Name:      "test.example.com",
+				Backends: []conf.Backend{
+					conf.Backend{
+						Addr:              l.Addr().String(),
+						SendProxyProtocol: conf.ProxyProtocolV1,
+					},
+				},
+			},
+		},
+	})
+
+	go s.Run()
+	// wait for the listener to bind
+	<-s.Ready()
+	defer s.mux.Close()
+
+	local := make(chan string, 1)
+	go func() {
+		raw, err := net.Dial("tcp", bindAddr)
+		if err != nil {
+			t.Errorf("Failed to dial: %v", err)
+			return
+		}
+		local <- raw.LocalAddr().String()
+		// the handshake never completes since the backend doesn't speak TLS
+		tls.Client(raw, &tls.Config{ServerName: "test.example.com", InsecureSkipVerify: true}).Handshake()
+	}()
+
+	in, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept new connection: %v", err)
+	}
+	defer in.Close()
+
+	got, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Error reading header from connection: %v", err)
+	}
+
+	host, port, _ := net.SplitHostPort(<-local)
+	expected := fmt.Sprintf("PROXY TCP4 %s 127.0.0.1 %s 55111\r\n", host, port)
+	if got != expected {
+		t.Errorf("Wrong PROXY header. Got %q, expected %q", got, expected)
+	}
+}
+
+func TestAcceptProxyProtocol(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	s := mkServer(t, &conf.Binding{
+		Secure:        true,
+		ProxyProtocol: true,
+		BindAddr:      bindAddr,
+		Frontends: map[string]*conf.Frontend{
+			"test.example.com": &conf.Frontend{
+				BoundAddr: bindAddr,
+				Name:      "test.example.com",
+				Backends: []conf.Backend{
+					conf.Backend{
+						Addr:              l.Addr().String(),
+						SendProxyProtocol: conf.ProxyProtocolV1,
+					},
+				},
+			},
+		},
+	})
+
+	go s.Run()
+	// wait for the listener to bind
+	<-s.Ready()
+	defer s.mux.Close()
+
+	// the upstream load balancer's header comes before the ClientHello
+	header := "PROXY TCP4 203.0.113.7 198.51.100.1 41234 443\r\n"
+	go func() {
+		raw, err := net.Dial("tcp", bindAddr)
+		if err != nil {
+			t.Errorf("Failed to dial: %v", err)
+			return
+		}
+		raw.Write([]byte(header))
+		// the handshake never completes since the backend doesn't speak TLS
+		tls.Client(raw, &tls.Config{ServerName: "test.example.com", InsecureSkipVerify: true}).Handshake()
+	}()
+
+	in, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept new connection: %v", err)
+	}
+	defer in.Close()
+
+	// the backend sees the recovered client address
+	got, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Error reading header from connection: %v", err)
+	}
+	if got != header {
+		t.Errorf("Wrong PROXY header. Got %q, expected %q", got, header)
+	}
+}
+
+// mkClientCA writes a CA to a temp file and returns it with a client
+// certificate signed by it
+func mkClientCA(t *testing.T, commonName string) (string, tls.Certificate) {
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Failed to create CA: %v", err)
+	}
+
+	clientKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	client := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	clientDER, err := x509.CreateCertificate(rand.Reader, client, ca, &clientKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Failed to create client certificate: %v", err)
+	}
+
+	f, err := ioutil.TempFile("", "goproxy-ca")
+	if err != nil {
+		t.Fatalf("Failed to create CA file: %v", err)
+	}
+	pem.Encode(f, &pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	f.Close()
+
+	return f.Name(), tls.Certificate{Certificate: [][]byte{clientDER}, PrivateKey: clientKey}
+}
+
+func TestClientAuth(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	caFile, clientCert := mkClientCA(t, "client.example.com")
+	defer os.Remove(caFile)
+
+	s := mkServer(t, &conf.Binding{
+		Secure:   true,
+		BindAddr: bindAddr,
+		Frontends: map[string]*conf.Frontend{
+			"test.example.com": &conf.Frontend{
+				TLSCrt:     "/snakeoil.crt",
+				TLSKey:     "/snakeoil.key",
+				ClientCA:   caFile,
+				ClientAuth: conf.ClientAuthVerify,
+				BoundAddr:  bindAddr,
+				Name:       "test.example.com",
+				Backends: []conf.Backend{
+					conf.Backend{
+						Addr:              l.Addr().String(),
+						SendProxyProtocol: conf.ProxyProtocolV2,
+					},
+				},
+			},
+		},
+	})
+
+	go s.Run()
+	// wait for the listener to bind
+	<-s.Ready()
+	defer s.mux.Close()
+
+	// without a client certificate the handshake fails
+	out, err := tls.Dial("tcp", bindAddr, &tls.Config{ServerName: "test.example.com", InsecureSkipVerify: true})
+	if err == nil {
+		_, err = out.Read(make([]byte, 1))
+	}
+	if err == nil {
+		t.Fatalf("Expected error without a client certificate")
+	}
+
+	expected := []byte("Hello World")
+	go func() {
+		out, err := tls.Dial("tcp", bindAddr, &tls.Config{
+			ServerName:         "test.example.com",
+			InsecureSkipVerify: true,
+			Certificates:       []tls.Certificate{clientCert},
+		})
+		if err != nil {
+			t.Errorf("Failed to dial: %v", err)
+			return
+		}
+		out.Write(expected)
+		out.Close()
+	}()
+
+	in, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept new connection: %v", err)
+	}
+
+	got, err := ioutil.ReadAll(in)
+	if err != nil {
+		t.Fatalf("Error reading data from connection: %v", err)
+	}
+
+	// the verified client's common name is forwarded in the PROXY header
+	if !bytes.Contains(got, []byte("client.example.com")) {
+		t.Errorf("Expected the client's common name in the PROXY header, got %q", got)
+	}
+	if !bytes.HasSuffix(got, expected) {
+		t.Errorf("Wrong data read from connection. Got %v, expected %v", got, expected)
+	}
+}
+
+func TestBackendTLS(t *testing.T) {
+	l, addr := backendOrFail(t)
+
+	s := mkServer(t, &conf.Binding{
+		Secure:   true,
+		BindAddr: bindAddr,
+		Frontends: map[string]*conf.Frontend{
+			"test.example.com": &conf.Frontend{
+				TLSCrt:    "/snakeoil.crt",
+				TLSKey:    "/snakeoil.key",
+				BoundAddr: bindAddr,
+				Name:      "test.example.com",
+				Backends: []conf.Backend{
+					conf.Backend{
+						Addr:               addr,
+						TLS:                true,
+						InsecureSkipVerify: true,
+					},
+				},
+			},
+		},
+	})
+
+	go s.Run()
+	// wait for the listener to bind
+	<-s.Ready()
+	defer s.mux.Close()
+
+	expected := []byte("Hello World")
+	go func() {
+		out, err := tls.Dial("tcp", bindAddr, &tls.Config{ServerName: "test.example.com", InsecureSkipVerify: true})
+		if err != nil {
+			t.Errorf("Failed to dial: %v", err)
+			return
+		}
+		out.Write(expected)
+		out.Close()
+	}()
+
+	in, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept new connection: %v", err)
+	}
+
+	// the backend's listener decrypts the new TLS session
+	got, err := ioutil.ReadAll(in)
+	if err != nil {
+		t.Fatalf("Error reading data from connection: %v", err)
+	}
+
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Wrong data read from connection. Got %v, expected %v", got, expected)
+	}
+}
+
+func TestStopDrain(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	s := mkServer(t, &conf.Binding{
+		BindAddr: bindAddr,
+		Frontends: map[string]*conf.Frontend{
+			"test.example.com": &conf.Frontend{
+				BoundAddr: bindAddr,
+				Name:      "test.example.com",
+				Backends: []conf.Backend{
+					conf.Backend{
+						Addr: l.Addr().String(),
+					},
+				},
+			},
+		},
+	})
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Run()
+		close(stopped)
+	}()
+	// wait for the listener to bind
+	<-s.Ready()
+
+	out, err := net.Dial("tcp", bindAddr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	out.Write([]byte("GET / HTTP/1.1\r\nHost: test.example.com\r\n\r\n"))
+	in, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept new connection: %v", err)
+	}
+
+	s.Stop()
+	<-stopped
+
+	if _, err := net.Dial("tcp", bindAddr); err == nil {
+		t.Errorf("Expected dialing a stopped server to fail")
+	}
+
+	// the proxied connection is still open
+	if s.Drain(200 * time.Millisecond) {
+		t.Fatalf("Expected draining to time out with an open connection")
+	}
+	in.Write([]byte("still here"))
+	buf := make([]byte, len("still here"))
+	if _, err := io.ReadFull(out, buf); err != nil {
+		t.Fatalf("Expected the connection to carry on after stopping: %v", err)
+	}
+
+	out.Close()
+	in.Close()
+	if !s.Drain(2 * time.Second) {
+		t.Errorf("Expected draining to finish, %v sessions open", s.Sessions())
+	}
+}
+
+func TestCloseAfterDrain(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	s := mkServer(t, &conf.Binding{
+		BindAddr: bindAddr,
+		Frontends: map[string]*conf.Frontend{
+			"test.example.com": &conf.Frontend{
+				BoundAddr: bindAddr,
+				Name:      "test.example.com",
+				Backends:  []conf.Backend{conf.Backend{Addr: l.Addr().String()}},
+			},
+		},
+	})
+	go s.Run()
+	<-s.Ready()
+
+	out, err := net.Dial("tcp", bindAddr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer out.Close()
+	out.Write([]byte("GET / HTTP/1.1\r\nHost: test.example.com\r\n\r\n"))
+	in, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept new connection: %v", err)
+	}
+	defer in.Close()
+
+	s.Stop()
+	<-s.Done()
+	if s.Drain(100 * time.Millisecond) {
+		t.Fatalf("Expected draining to time out with an open connection")
+	}
+
+	// the lingering connection is closed on both sides
+	s.Close()
+	expectClosed(t, in, 2*time.Second)
+	if !s.Drain(2 * time.Second) {
+		t.Errorf("Expected no sessions after closing, %v open", s.Sessions())
+	}
+}
+
+func TestUpdateBinding(t *testing.T) {
+	mkFrontend := func(name, addr string) *conf.Frontend {
+		return &conf.Frontend{
+			BoundAddr: bindAddr,
+			Name:      name,
+			Backends: []conf.Backend{
+				conf.Backend{
+					Addr: addr,
+				},
+			},
+		}
+	}
+
+	s := mkServer(t, &conf.Binding{
+		Secure:   true,
+		BindAddr: bindAddr,
+		Frontends: map[string]*conf.Frontend{
+			"a.example.com": mkFrontend("a.example.com", "127.0.0.1:1001"),
+			"b.example.com": mkFrontend("b.example.com", "127.0.0.1:1002"),
+			"c.example.com": mkFrontend("c.example.com", "127.0.0.1:1003"),
+		},
+	})
+
+	go s.Run()
+	// wait for the listener to bind
+	<-s.Ready()
+	defer s.mux.Close()
+
+	// a frontend from a watched file isn't part of the binding
+	s.AddFrontend(mkFrontend("watched.example.com", "127.0.0.1:1004"))
+
+	updated, err := s.UpdateBinding(&conf.Binding{
+		Secure:   true,
+		BindAddr: bindAddr,
+		Frontends: map[string]*conf.Frontend{
+			"a.example.com": mkFrontend("a.example.com", "127.0.0.1:1001"),
+			"b.example.com": mkFrontend("b.example.com", "127.0.0.1:2002"),
+			"d.example.com": mkFrontend("d.example.com", "127.0.0.1:1005"),
+		},
+	})
+	if !updated || err != nil {
+		t.Fatalf("Expected the binding to be updated, got %v, %v", updated, err)
+	}
+
+	backends := map[string]string{}
+	for _, f := range s.Status().Frontends {
+		backends[f.Name] = f.Backends[0].Addr
+	}
+	expected := map[string]string{
+		"a.example.com":       "127.0.0.1:1001",
+		"b.example.com":       "127.0.0.1:2002",
+		"d.example.com":       "127.0.0.1:1005",
+		"watched.example.com": "127.0.0.1:1004",
+	}
+	if !reflect.DeepEqual(backends, expected) {
+		t.Errorf("Wrong frontends after update. Got %v, expected %v", backends, expected)
+	}
+
+	// the binding's own settings need a new server
+	updated, err = s.UpdateBinding(&conf.Binding{
+		BindAddr:  bindAddr,
+		Frontends: map[string]*conf.Frontend{},
+	})
+	if updated || err != nil {
+		t.Errorf("Expected the binding not to be updated, got %v, %v", updated, err)
+	}
+	if n := len(s.Status().Frontends); n != 4 {
+		t.Errorf("Expected the frontends to be left alone, got %v", n)
+	}
+}
+
+// runTCPServer runs a tcp binding with the frontend until stop is called
+func runTCPServer(t *testing.T, front *conf.Frontend) (stop func()) {
+	front.BoundAddr = bindAddr
+	front.Name = bindAddr
+	s := mkServer(t, &conf.Binding{
+		Mode:     conf.ModeTCP,
+		BindAddr: bindAddr,
+		Frontend: front,
+		Frontends: map[string]*conf.Frontend{
+			front.Name: front,
+		},
+	})
+	go s.Run()
+	<-s.Ready()
+	return func() {
+		s.Stop()
+		<-s.Done()
+	}
+}
+
+// expectClosed fails unless the connection is closed within the timeout
+func expectClosed(t *testing.T, c net.Conn, timeout time.Duration) {
+	c.SetReadDeadline(time.Now().Add(timeout))
+	if _, err := io.Copy(ioutil.Discard, c); err != nil {
+		t.Errorf("Expected the connection to be closed, got %v", err)
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer l.Close()
+	addr := l.Addr().String()
+
+	t.Run("idle", func(t *testing.T) {
+		stop := runTCPServer(t, &conf.Frontend{
+			IdleTimeout: 100,
+			Backends:    []conf.Backend{conf.Backend{Addr: addr}},
+		})
+		defer stop()
+
+		out, err := net.Dial("tcp", bindAddr)
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		defer out.Close()
+		out.Write([]byte("x"))
+		in, err := l.Accept()
+		if err != nil {
+			t.Fatalf("Failed to accept new connection: %v", err)
+		}
+		defer in.Close()
+
+		start := time.Now()
+		expectClosed(t, out, 2*time.Second)
+		expectClosed(t, in, 2*time.Second)
+		if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+			t.Errorf("Expected the connection to stay open until the idle timeout, closed after %v", elapsed)
+		}
+	})
+
+	t.Run("max connection duration", func(t *testing.T) {
+		stop := runTCPServer(t, &conf.Frontend{
+			MaxConnectionDuration: 200,
+			Backends:              []conf.Backend{conf.Backend{Addr: addr}},
+		})
+		defer stop()
+
+		out, err := net.Dial("tcp", bindAddr)
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		defer out.Close()
+		// busy connections are closed too
+		go func() {
+			for {
+				if _, err := out.Write([]byte("x")); err != nil {
+					return
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+		}()
+		in, err := l.Accept()
+		if err != nil {
+			t.Fatalf("Failed to accept new connection: %v", err)
+		}
+		defer in.Close()
+
+		expectClosed(t, in, 2*time.Second)
+	})
+
+	t.Run("handshake", func(t *testing.T) {
+		stop := runTCPServer(t, &conf.Frontend{
+			TLSCrt:           "/snakeoil.crt",
+			TLSKey:           "/snakeoil.key",
+			HandshakeTimeout: 100,
+			Backends:         []conf.Backend{conf.Backend{Addr: addr}},
+		})
+		defer stop()
+
+		// never starts the handshake
+		out, err := net.Dial("tcp", bindAddr)
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		defer out.Close()
+
+		expectClosed(t, out, 2*time.Second)
+	})
+}
+
+func TestHalfClose(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer l.Close()
+	addr := l.Addr().String()
+
+	// the backend only replies once the client is done sending
+	request := []byte("GET / HTTP/1.1\r\nHost: test.example.com\r\n\r\n")
+	response := []byte("HTTP/1.1 204 No Content\r\n\r\n")
+	go func() {
+		for {
+			in, err := l.Accept()
+			if err != nil {
+				return
+			}
+			got, err := ioutil.ReadAll(in)
+			if err != nil || !reflect.DeepEqual(got, request) {
+				t.Errorf("Wrong request read from connection. Got %q, %v", got, err)
+			}
+			in.Write(response)
+			in.Close()
+		}
+	}()
+
+	for _, tc := range []struct {
+		name  string
+		start func() (stop func())
+		dial  func() (net.Conn, error)
+	}{
+		{
+			"tcp",
+			func() func() {
+				return runTCPServer(t, &conf.Frontend{Backends: []conf.Backend{conf.Backend{Addr: addr}}})
+			},
+			func() (net.Conn, error) {
+				return net.Dial("tcp", bindAddr)
+			},
+		},
+		{
+			"terminated tls",
+			func() func() {
+				return runTCPServer(t, &conf.Frontend{
+					TLSCrt:   "/snakeoil.crt",
+					TLSKey:   "/snakeoil.key",
+					Backends: []conf.Backend{conf.Backend{Addr: addr}},
+				})
+			},
+			func() (net.Conn, error) {
+				return tls.Dial("tcp", bindAddr, &tls.Config{InsecureSkipVerify: true})
+			},
+		},
+		{
+			// the muxer wraps the client's connection
+			"http",
+			func() func() {
+				s := mkServer(t, &conf.Binding{
+					BindAddr: bindAddr,
+					Frontends: map[string]*conf.Frontend{
+						"test.example.com": &conf.Frontend{
+							BoundAddr: bindAddr,
+							Name:      "test.example.com",
+							Backends:  []conf.Backend{conf.Backend{Addr: addr}},
+						},
+					},
+				})
+				go s.Run()
+				<-s.Ready()
+				return func() {
+					s.Stop()
+					<-s.Done()
+				}
+			},
+			func() (net.Conn, error) {
+				return net.Dial("tcp", bindAddr)
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			stop := tc.start()
+			defer stop()
+
+			out, err := tc.dial()
+			if err != nil {
+				t.Fatalf("Failed to dial: %v", err)
+			}
+			defer out.Close()
+			out.Write(request)
+			if err := out.(interface{ CloseWrite() error }).CloseWrite(); err != nil {
+				t.Fatalf("Failed to close writing: %v", err)
+			}
+
+			out.SetReadDeadline(time.Now().Add(2 * time.Second))
+			got, err := ioutil.ReadAll(out)
+			if err != nil {
+				t.Fatalf("Error reading data from connection: %v", err)
+			}
+			if !reflect.DeepEqual(got, response) {
+				t.Errorf("Wrong data read from connection. Got %q, expected %q", got, response)
+			}
+		})
+	}
+}
+
+func TestHalfCloseTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	stop := runTCPServer(t, &conf.Frontend{
+		HalfCloseTimeout: 100,
+		Backends:         []conf.Backend{conf.Backend{Addr: l.Addr().String()}},
+	})
+	defer stop()
+
+	out, err := net.Dial("tcp", bindAddr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer out.Close()
+	in, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Failed to accept new connection: %v", err)
+	}
+	defer in.Close()
+
+	// the backend never replies or closes
+	out.(*net.TCPConn).CloseWrite()
+	expectClosed(t, out, 2*time.Second)
+}
+
+func TestConnectionLimits(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer l.Close()
+	addr := l.Addr().String()
+
+	// dial opens a proxied connection and returns the backend's end of it
+	dial := func(t *testing.T) (net.Conn, net.Conn) {
+		out, err := net.Dial("tcp", bindAddr)
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		in, err := l.Accept()
+		if err != nil {
+			t.Fatalf("Failed to accept new connection: %v", err)
+		}
+		return out, in
+	}
+
+	tests := []struct {
+		name   string
+		front  *conf.Frontend
+		reason string
+	}{
+		{"frontend", &conf.Frontend{
+			MaxConnections: 1,
+			Backends:       []conf.Backend{conf.Backend{Addr: addr}},
+		}, "frontend_limit"},
+		{"backend", &conf.Frontend{
+			Backends: []conf.Backend{conf.Backend{Addr: addr, MaxConnections: 1}},
+		}, "backend_limit"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stop := runTCPServer(t, tt.front)
+			defer stop()
+
+			rejected := rejectedConnections.WithLabelValues(bindAddr, bindAddr, tt.reason)
+			before := testutil.ToFloat64(rejected)
+
+			out, in := dial(t)
+			defer out.Close()
+			defer in.Close()
+
+			over, err := net.Dial("tcp", bindAddr)
+			if err != nil {
+				t.Fatalf("Failed to dial: %v", err)
+			}
+			defer over.Close()
+			expectClosed(t, over, 2*time.Second)
+			if got := testutil.ToFloat64(rejected) - before; got != 1 {
+				t.Errorf("Expected 1 rejected connection, got %v", got)
+			}
+		})
+	}
+
+	t.Run("queue", func(t *testing.T) {
+		stop := runTCPServer(t, &conf.Frontend{
+			MaxConnections: 1,
+			QueueSize:      1,
+			QueueTimeout:   2000,
+			Backends:       []conf.Backend{conf.Backend{Addr: addr}},
+		})
+		defer stop()
+
+		out, in := dial(t)
+		defer out.Close()
+
+		queued, err := net.Dial("tcp", bindAddr)
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		defer queued.Close()
+		time.Sleep(100 * time.Millisecond)
+
+		// the queue is full
+		over, err := net.Dial("tcp", bindAddr)
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		defer over.Close()
+		expectClosed(t, over, 2*time.Second)
+
+		// the queued connection gets the slot once the first one is done
+		out.Close()
+		in.Close()
+		l.(*net.TCPListener).SetDeadline(time.Now().Add(2 * time.Second))
+		defer l.(*net.TCPListener).SetDeadline(time.Time{})
+		in, err = l.Accept()
+		if err != nil {
+			t.Fatalf("Expected the queued connection to be proxied, got %v", err)
+		}
+		in.Close()
+	})
+}
+
+func TestACLs(t *testing.T) {
+	l, addr := backendOrFail(t)
+	defer l.Close()
+
+	tests := []struct {
+		name     string
+		binding  []string
+		frontend []string
+		allowed  bool
+		// the denied connections counter, empty for the binding's
+		counter string
+	}{
+		{"binding", []string{"127.0.0.0/8"}, nil, false, ""},
+		{"frontend", nil, []string{"127.0.0.1"}, false, "test.example.com"},
+		{"allowed", []string{"192.0.2.0/24"}, []string{"::1"}, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			front := &conf.Frontend{
+				BoundAddr: bindAddr,
+				Name:      "test.example.com",
+				Deny:      tt.frontend,
+				Backends:  []conf.Backend{conf.Backend{Addr: addr}},
+			}
+			s := mkServer(t, &conf.Binding{
+				BindAddr: bindAddr,
+				Deny:     tt.binding,
+				Frontends: map[string]*conf.Frontend{
+					front.Name: front,
+				},
+			})
+			go s.Run()
+			<-s.Ready()
+			defer func() {
+				s.Stop()
+				<-s.Done()
+			}()
+
+			denied := deniedConnections.WithLabelValues(bindAddr, tt.counter)
+			before := testutil.ToFloat64(denied)
+
+			out, err := net.Dial("tcp", bindAddr)
+			if err != nil {
+				t.Fatalf("Failed to dial: %v", err)
+			}
+			defer out.Close()
+			fmt.Fprintf(out, "GET / HTTP/1.1\r\nHost: test.example.com\r\n\r\n")
+
+			if tt.allowed {
+				in, err := l.Accept()
+				if err != nil {
+					t.Fatalf("Failed to accept new connection: %v", err)
+				}
+				in.Close()
+				return
+			}
+			// reset if it's closed before reading the request
+			out.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if _, err := io.Copy(ioutil.Discard, out); isTimeout(err) {
+				t.Errorf("Expected the connection to be closed, got %v", err)
+			}
+			if got := testutil.ToFloat64(denied) - before; got != 1 {
+				t.Errorf("Expected 1 denied connection, got %v", got)
+			}
+		})
+	}
+}
+
+func TestClientChecksProxyProtocol(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	front := &conf.Frontend{
+		BoundAddr: bindAddr,
+		Name:      "test.example.com",
+		Backends:  []conf.Backend{conf.Backend{Addr: l.Addr().String()}},
+	}
+	s := mkServer(t, &conf.Binding{
+		BindAddr:      bindAddr,
+		ProxyProtocol: true,
+		Deny:          []string{"127.0.0.1"},
+		ClientLimits:  &conf.ClientLimits{MaxConnections: 10, IPv4Prefix: 32, IPv6Prefix: 64},
+		Frontends: map[string]*conf.Frontend{
+			front.Name: front,
+		},
+	})
+	go s.Run()
+	<-s.Ready()
+	defer func() {
+		s.Stop()
+		<-s.Done()
+	}()
+
+	// the lists and limits apply to the address from the header, a client
+	// that never sends its header doesn't hold up the others
+	silent, err := net.Dial("tcp", bindAddr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer silent.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	out, err := net.Dial("tcp", bindAddr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer out.Close()
+	fmt.Fprintf(out, "PROXY TCP4 203.0.113.7 198.51.100.1 41234 80\r\nGET / HTTP/1.1\r\nHost: test.example.com\r\n\r\n")
+
+	l.(*net.TCPListener).SetDeadline(time.Now().Add(2 * time.Second))
+	in, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Expected the connection to be proxied, got %v", err)
+	}
+	in.Close()
+}
@@ -0,0 +1,314 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// the largest UDP payload
+const maxDatagramSize = 64 * 1024
+
+// runUDP relays datagrams until the server is stopped, each client address
+// gets a session with a backend of the binding's frontend
+func (s *Server) runUDP(bindAddr string) error {
+	bindACL, err := newACL(s.Allow, s.Deny)
+	if err != nil {
+		return err
+	}
+
+	// bind to port, unless the socket was passed to us
+	pc := s.PacketConn
+	if pc == nil {
+		if pc, err = net.ListenPacket("udp", bindAddr); err != nil {
+			return err
+		}
+		s.PacketConn = pc
+	}
+	s.Info("Serving datagrams", zap.String("addr", pc.LocalAddr().String()))
+
+	defer s.RemoveFrontends()
+	s.addFrontends()
+
+	p := &udpProxy{
+		s:        s,
+		pc:       pc,
+		bindAddr: bindAddr,
+		acl:      bindACL,
+		timeout:  time.Duration(s.SessionTimeout) * time.Millisecond,
+		sessions: make(map[string]*udpSession),
+	}
+	running := make(chan struct{})
+	go func() {
+		defer close(running)
+		p.run()
+	}()
+
+	// signal we're ready
+	close(s.ready)
+
+	<-s.stop
+	s.Info("Stopped accepting datagrams", zap.String("addr", bindAddr))
+	// stop reading but keep the socket for the sessions' replies, they
+	// drain like connections until they're idle or Close closes them
+	pc.SetReadDeadline(time.Now())
+	<-running
+	p.sessionsL.Lock()
+	open := len(p.sessions)
+	p.sessionsL.Unlock()
+	if open == 0 {
+		pc.Close()
+		return nil
+	}
+	go func() {
+		p.sessionsWG.Wait()
+		pc.Close()
+	}()
+
+	return nil
+}
+
+type udpProxy struct {
+	s        *Server
+	pc       net.PacketConn
+	bindAddr string
+	// the binding's allow and deny lists
+	acl *acl
+	// sessions without datagrams either way for this long are closed,
+	// never if 0
+	timeout time.Duration
+
+	sessionsL sync.Mutex
+	// by client address
+	sessions map[string]*udpSession
+	// done once the sessions are closed
+	sessionsWG sync.WaitGroup
+}
+
+type udpSession struct {
+	f      *frontend
+	client net.Addr
+	// closed once the backend is dialed, backend and conn are nil if that
+	// failed
+	ready   chan struct{}
+	backend *backend
+	// connected to the backend
+	conn    net.Conn
+	started time.Time
+	// unix nanoseconds of the last datagram either way
+	lastActive int64
+}
+
+func (sess *udpSession) touch() {
+	atomic.StoreInt64(&sess.lastActive, time.Now().UnixNano())
+}
+
+// idleUntil returns when the session times out if it stays idle
+func (sess *udpSession) idleUntil(timeout time.Duration) time.Time {
+	return time.Unix(0, atomic.LoadInt64(&sess.lastActive)).Add(timeout)
+}
+
+// run forwards the clients' datagrams to their session's backend
+func (p *udpProxy) run() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := p.pc.ReadFrom(buf)
+		if err != nil {
+			if p.s.stopping() {
+				return
+			}
+			p.s.Error("Failed to read datagram", zap.Error(err))
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				continue
+			}
+			return
+		}
+
+		if !p.acl.allows(addr) {
+			udpDropped.WithLabelValues(p.bindAddr, "denied").Inc()
+			p.s.Debug("Denied datagram", zap.String("from", addr.String()))
+			continue
+		}
+		sess, started, reason := p.session(addr)
+		if sess == nil {
+			udpDropped.WithLabelValues(p.bindAddr, reason).Inc()
+			continue
+		}
+		if started {
+			go p.start(sess, append([]byte(nil), buf[:n]...))
+			continue
+		}
+		select {
+		case <-sess.ready:
+		default:
+			udpDropped.WithLabelValues(p.bindAddr, "pending").Inc()
+			continue
+		}
+		if sess.conn == nil {
+			udpDropped.WithLabelValues(p.bindAddr, "no_backend").Inc()
+			continue
+		}
+		p.forward(sess, buf[:n])
+	}
+}
+
+// session returns the client's session, or a new one that start has to
+// dial a backend for. It's nil with the reason to drop the datagram if
+// there's no frontend or the frontend denies the client.
+func (p *udpProxy) session(client net.Addr) (sess *udpSession, started bool, reason string) {
+	p.sessionsL.Lock()
+	defer p.sessionsL.Unlock()
+
+	if sess, ok := p.sessions[client.String()]; ok {
+		return sess, false, ""
+	}
+
+	f := p.s.matchFrontend("")
+	if f == nil {
+		return nil, false, "no_backend"
+	}
+	if !f.acl.allows(client) {
+		f.Debug("Denied datagram",
+			zap.String("frontend", f.Name),
+			zap.String("from", client.String()),
+		)
+		return nil, false, "denied"
+	}
+
+	sess = &udpSession{
+		f:      f,
+		client: client,
+		ready:  make(chan struct{}),
+	}
+	p.sessions[client.String()] = sess
+	p.sessionsWG.Add(1)
+	return sess, true, ""
+}
+
+// start dials a backend picked by the frontend's strategy for the new
+// session, forwards the client's first datagram and relays the replies.
+// It runs on its own so a slow dial doesn't hold up other clients, the
+// client's own datagrams are dropped until it's done.
+func (p *udpProxy) start(sess *udpSession, first []byte) {
+	defer p.sessionsWG.Done()
+
+	f := sess.f
+	backend, conn, err := f.dialBackend(&connContext{clientAddr: sess.client})
+	if err != nil {
+		p.sessionsL.Lock()
+		delete(p.sessions, sess.client.String())
+		p.sessionsL.Unlock()
+		close(sess.ready)
+
+		udpDropped.WithLabelValues(p.bindAddr, "no_backend").Inc()
+		f.Error("Failed to connect to a backend",
+			zap.String("frontend", f.Name),
+			zap.String("from", sess.client.String()),
+			zap.Error(err),
+		)
+		return
+	}
+
+	sess.backend, sess.conn, sess.started = backend, conn, time.Now()
+	sess.touch()
+	p.s.conns.add(conn)
+	if f.sessions != nil {
+		atomic.AddInt64(f.sessions, 1)
+	}
+	udpSessions.WithLabelValues(f.BoundAddr, f.Name).Inc()
+	udpSessionsTotal.WithLabelValues(f.BoundAddr, f.Name).Inc()
+	f.Debug("Started UDP session",
+		zap.String("from", sess.client.String()),
+		zap.String("to", backend.Addr),
+	)
+	close(sess.ready)
+
+	p.forward(sess, first)
+	p.relay(sess)
+}
+
+// forward sends a client's datagram to its session's backend
+func (p *udpProxy) forward(sess *udpSession, b []byte) {
+	sess.touch()
+	if _, err := sess.conn.Write(b); err != nil {
+		udpDropped.WithLabelValues(p.bindAddr, "backend_write").Inc()
+		sess.f.Debug("Failed to forward datagram",
+			zap.String("from", sess.client.String()),
+			zap.String("to", sess.backend.Addr),
+			zap.Error(err),
+		)
+		return
+	}
+	udpDatagrams.WithLabelValues(sess.f.BoundAddr, sess.f.Name, sess.backend.Addr, directionIn).Inc()
+	bytesCopied.WithLabelValues(sess.f.BoundAddr, sess.f.Name, sess.backend.Addr, directionIn).Add(float64(len(b)))
+}
+
+// relay sends the backend's replies to the client until the session is
+// idle for the timeout or closed
+func (p *udpProxy) relay(sess *udpSession) {
+	defer p.closeSession(sess)
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		if p.timeout > 0 {
+			sess.conn.SetReadDeadline(sess.idleUntil(p.timeout))
+		}
+		n, err := sess.conn.Read(buf)
+		if err != nil {
+			// the client may have sent datagrams since the deadline was set
+			if isTimeout(err) && time.Now().Before(sess.idleUntil(p.timeout)) {
+				continue
+			}
+			if !isTimeout(err) {
+				sess.f.Debug("Failed to read reply",
+					zap.String("from", sess.backend.Addr),
+					zap.Error(err),
+				)
+			}
+			return
+		}
+
+		sess.touch()
+		if _, err := p.pc.WriteTo(buf[:n], sess.client); err != nil {
+			udpDropped.WithLabelValues(p.bindAddr, "client_write").Inc()
+			sess.f.Debug("Failed to relay datagram",
+				zap.String("from", sess.backend.Addr),
+				zap.String("to", sess.client.String()),
+				zap.Error(err),
+			)
+			continue
+		}
+		udpDatagrams.WithLabelValues(sess.f.BoundAddr, sess.f.Name, sess.backend.Addr, directionOut).Inc()
+		bytesCopied.WithLabelValues(sess.f.BoundAddr, sess.f.Name, sess.backend.Addr, directionOut).Add(float64(n))
+	}
+}
+
+func (p *udpProxy) closeSession(sess *udpSession) {
+	p.sessionsL.Lock()
+	if p.sessions[sess.client.String()] == sess {
+		delete(p.sessions, sess.client.String())
+	}
+	p.sessionsL.Unlock()
+
+	sess.conn.Close()
+	p.s.conns.remove(sess.conn)
+	f := sess.f
+	sess.backend.release()
+	if f.sessions != nil {
+		atomic.AddInt64(f.sessions, -1)
+	}
+	udpSessions.WithLabelValues(f.BoundAddr, f.Name).Dec()
+	f.Debug("Closed UDP session",
+		zap.String("from", sess.client.String()),
+		zap.String("to", sess.backend.Addr),
+		zap.Duration("duration", time.Since(sess.started)),
+	)
+}
+
+func isTimeout(err error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/acls/goproxy/conf"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// udpEchoOrFail starts a backend that sends every datagram back
+func udpEchoOrFail(t *testing.T) (net.PacketConn, string) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc, pc.LocalAddr().String()
+}
+
+func TestUDPMode(t *testing.T) {
+	backend, addr := udpEchoOrFail(t)
+	defer backend.Close()
+
+	front := &conf.Frontend{
+		BoundAddr: bindAddr,
+		Name:      bindAddr,
+		Backends: []conf.Backend{
+			conf.Backend{
+				Addr: addr,
+			},
+		},
+	}
+	s := mkServer(t, &conf.Binding{
+		Mode:           conf.ModeUDP,
+		BindAddr:       bindAddr,
+		SessionTimeout: 200,
+		Frontend:       front,
+		Frontends: map[string]*conf.Frontend{
+			front.Name: front,
+		},
+	})
+
+	go s.Run()
+	<-s.Ready()
+	defer func() {
+		s.Stop()
+		<-s.Done()
+	}()
+
+	sessions := udpSessionsTotal.WithLabelValues(bindAddr, bindAddr)
+	started := testutil.ToFloat64(sessions)
+
+	for _, msg := range []string{"one", "two"} {
+		c, err := net.Dial("udp", bindAddr)
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		defer c.Close()
+
+		// a few datagrams share the client's session
+		for i := 0; i < 3; i++ {
+			if _, err := c.Write([]byte(msg)); err != nil {
+				t.Fatalf("Failed to write: %v", err)
+			}
+			c.SetReadDeadline(time.Now().Add(2 * time.Second))
+			buf := make([]byte, 16)
+			n, err := c.Read(buf)
+			if err != nil {
+				t.Fatalf("Failed to read reply: %v", err)
+			}
+			if got := string(buf[:n]); got != msg {
+				t.Errorf("Wrong reply. Got %q, expected %q", got, msg)
+			}
+		}
+	}
+
+	if got := testutil.ToFloat64(sessions) - started; got != 2 {
+		t.Errorf("Expected 2 sessions, got %v", got)
+	}
+	if got := s.Sessions(); got != 2 {
+		t.Errorf("Expected 2 open sessions, got %v", got)
+	}
+
+	// idle sessions are closed after the timeout
+	if !s.Drain(2 * time.Second) {
+		t.Errorf("Expected the sessions to time out, %v still open", s.Sessions())
+	}
+	if got := testutil.ToFloat64(udpSessions.WithLabelValues(bindAddr, bindAddr)); got != 0 {
+		t.Errorf("Expected no open sessions, got %v", got)
+	}
+}
+
+func TestUDPDrain(t *testing.T) {
+	// replies a while after each datagram
+	backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer backend.Close()
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := backend.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			time.Sleep(200 * time.Millisecond)
+			backend.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	front := &conf.Frontend{
+		BoundAddr: bindAddr,
+		Name:      bindAddr,
+		Backends: []conf.Backend{
+			conf.Backend{
+				Addr: backend.LocalAddr().String(),
+			},
+		},
+	}
+	s := mkServer(t, &conf.Binding{
+		Mode:     conf.ModeUDP,
+		BindAddr: bindAddr,
+		Frontend: front,
+		Frontends: map[string]*conf.Frontend{
+			front.Name: front,
+		},
+	})
+
+	go s.Run()
+	<-s.Ready()
+
+	c, err := net.Dial("udp", bindAddr)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for s.Sessions() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the session's reply still comes after the server stopped
+	s.Stop()
+	<-s.Done()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 16)
+	n, err := c.Read(buf)
+	if err != nil {
+		t.Fatalf("Failed to read reply after stopping: %v", err)
+	}
+	if got := string(buf[:n]); got != "ping" {
+		t.Errorf("Wrong reply. Got %q, expected %q", got, "ping")
+	}
+
+	if s.Drain(100 * time.Millisecond) {
+		t.Fatalf("Expected the session to still be draining")
+	}
+	s.Close()
+	if !s.Drain(2 * time.Second) {
+		t.Errorf("Expected the session to be closed, %v still open", s.Sessions())
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/acls/goproxy/conf"
+	"github.com/acls/goproxy/proxy"
+)
+
+// servers runs a proxy.Server for each binding of the configuration
+type servers struct {
+	baseDir      string
+	watcher      *conf.ConfigWatcher
+	admin        *proxy.Admin
+	inherited    *proxy.Listeners
+	drainTimeout time.Duration
+
+	running map[string]*proxy.Server
+	// of the metrics and admin API, passed on with the servers' on upgrade
+	listeners []net.Listener
+	// closed once shutting down, the listeners' errors are expected then
+	closing chan struct{}
+}
+
+// start runs a server for the binding once it's listening
+func (ss *servers) start(key string, binding *conf.Binding) error {
+	s := ss.newServer(key, binding)
+	// nil unless the socket was passed to us
+	if binding.Mode == conf.ModeUDP {
+		s.PacketConn = ss.inherited.TakePacketConn("udp", key)
+	} else {
+		s.Listener = ss.inherited.Take("tcp", key)
+	}
+	if err := ss.run(s); err != nil {
+		return err
+	}
+	return ss.add(key, s)
+}
+
+// restart replaces the server of a binding whose own settings changed. The
+// new server takes over a duplicate of the old one's socket so connections
+// aren't refused in between, and the old one keeps running if the new one
+// fails to start.
+func (ss *servers) restart(key string, binding *conf.Binding) error {
+	old := ss.running[key]
+	// a udp socket can't serve a tcp binding or the other way around
+	if (old.Mode == conf.ModeUDP) != (binding.Mode == conf.ModeUDP) {
+		ss.stop(key)
+		return ss.start(key, binding)
+	}
+
+	s := ss.newServer(key, binding)
+	var err error
+	if binding.Mode == conf.ModeUDP {
+		s.PacketConn, err = proxy.DupPacketConn(old.PacketConn)
+	} else {
+		s.Listener, err = proxy.DupListener(old.Listener)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to take over the socket: %v", err)
+	}
+	if err := ss.run(s); err != nil {
+		if s.PacketConn != nil {
+			s.PacketConn.Close()
+		}
+		if s.Listener != nil {
+			s.Listener.Close()
+		}
+		return err
+	}
+
+	ss.stop(key)
+	return ss.add(key, s)
+}
+
+func (ss *servers) newServer(key string, binding *conf.Binding) *proxy.Server {
+	s := &proxy.Server{
+		Name:    key,
+		Binding: binding,
+		Logger:  zap.L(),
+		Watcher: ss.watcher,
+	}
+	s.Init()
+	return s
+}
+
+// run runs the server and waits until it's listening
+func (ss *servers) run(s *proxy.Server) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.Run()
+	}()
+	select {
+	case <-s.Ready():
+		return nil
+	case err := <-errc:
+		return err
+	}
+}
+
+// add watches the running server's directory and adds it to the admin API
+func (ss *servers) add(key string, s *proxy.Server) error {
+	if s.Watch {
+		dir := path.Join(ss.baseDir, key)
+		_ = os.MkdirAll(dir, os.ModeDir|os.ModePerm)
+
+		if err := ss.watcher.Add(dir, s.BindAddr, s); err != nil {
+			s.Stop()
+			return fmt.Errorf("Failed to add watch directory '%s': %v", dir, err)
+		}
+	}
+	if ss.admin != nil {
+		ss.admin.AddServer(s)
+	}
+	ss.running[key] = s
+	return nil
+}
+
+// stop stops the server once its listener is closed and drains its
+// connections in the background
+func (ss *servers) stop(key string) {
+	s := ss.running[key]
+	delete(ss.running, key)
+
+	if s.Watch {
+		if err := ss.watcher.Remove(path.Join(ss.baseDir, key)); err != nil {
+			zap.L().Warn("Failed to remove watch directory",
+				zap.String("server", key),
+				zap.Error(err),
+			)
+		}
+	}
+	if ss.admin != nil {
+		ss.admin.RemoveServer(key)
+	}
+	s.Stop()
+	<-s.Done()
+	go ss.drain(s, ss.drainTimeout)
+}
+
+func (ss *servers) drain(s *proxy.Server, timeout time.Duration) {
+	if !s.Drain(timeout) {
+		zap.L().Warn("Closing connections that didn't finish draining",
+			zap.String("server", s.Name),
+			zap.Int64("sessions", s.Sessions()),
+			zap.Duration("timeout", timeout),
+		)
+		s.Close()
+	}
+}
+
+// reload starts servers for new bindings, stops those of removed ones and
+// updates the rest. Bindings whose own settings changed get a new server.
+func (ss *servers) reload(config *conf.Configuration) {
+	ss.drainTimeout = time.Duration(config.DrainTimeout) * time.Millisecond
+
+	for key := range ss.running {
+		if _, ok := config.Bindings[key]; !ok {
+			zap.L().Info("Stopping removed binding", zap.String("server", key))
+			ss.stop(key)
+		}
+	}
+
+	for key, binding := range config.Bindings {
+		if s, ok := ss.running[key]; ok {
+			updated, err := s.UpdateBinding(binding)
+			if err != nil {
+				zap.L().Error("Failed to update frontends",
+					zap.String("server", key),
+					zap.Error(err),
+				)
+			}
+			if updated {
+				continue
+			}
+			zap.L().Info("Restarting changed binding", zap.String("server", key))
+			if err := ss.restart(key, binding); err != nil {
+				zap.L().Error("Failed to restart",
+					zap.String("server", key),
+					zap.Error(err),
+				)
+			}
+			continue
+		}
+
+		zap.L().Info("Starting new binding", zap.String("server", key))
+		if err := ss.start(key, binding); err != nil {
+			zap.L().Error("Failed to start",
+				zap.String("server", key),
+				zap.Error(err),
+			)
+		}
+	}
+}
+
+// shutdown stops the servers and waits for their proxied connections to
+// finish, up to the drain timeout. handOver is set when an upgraded process
+// took over the listeners.
+func (ss *servers) shutdown(handOver bool) {
+	// the upgraded process serves the metrics and admin API while we drain
+	close(ss.closing)
+	for _, l := range ss.listeners {
+		// leave the socket file to the upgraded process
+		if ul, ok := l.(*net.UnixListener); ok && handOver {
+			ul.SetUnlinkOnClose(false)
+		}
+		l.Close()
+	}
+
+	for _, s := range ss.running {
+		s.Stop()
+	}
+
+	var wg sync.WaitGroup
+	for _, s := range ss.running {
+		wg.Add(1)
+		go func(s *proxy.Server) {
+			defer wg.Done()
+			ss.drain(s, ss.drainTimeout)
+		}(s)
+	}
+	wg.Wait()
+	zap.L().Info("Stopped")
+}
+
+// shuttingDown returns whether shutdown closed the listeners
+func (ss *servers) shuttingDown() bool {
+	select {
+	case <-ss.closing:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+
+	"go.uber.org/zap"
+
+	"github.com/acls/goproxy/proxy"
+)
+
+const (
+	// parentPidEnv is the process an upgraded process tells to stop
+	parentPidEnv = "GOPROXY_PARENT_PID"
+)
+
+var upgrading int32
+
+// upgrade starts the goproxy binary again with the same arguments and
+// passes it the listeners. It stops this process with SIGTERM once its
+// servers are ready, so this one drains while it takes over accepting.
+func upgrade(ss *servers) error {
+	if !atomic.CompareAndSwapInt32(&upgrading, 0, 1) {
+		return errors.New("Already upgrading")
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		atomic.StoreInt32(&upgrading, 0)
+		return err
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	var listeners []interface{}
+	for _, l := range ss.listeners {
+		listeners = append(listeners, l)
+	}
+	for _, s := range ss.running {
+		if s.PacketConn != nil {
+			listeners = append(listeners, s.PacketConn)
+		} else {
+			listeners = append(listeners, s.Listener)
+		}
+	}
+	for _, l := range listeners {
+		f, err := proxy.ListenerFile(l)
+		if err != nil {
+			atomic.StoreInt32(&upgrading, 0)
+			return err
+		}
+		files = append(files, f)
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%d", proxy.InheritFdsEnv, len(files)),
+		fmt.Sprintf("%s=%d", parentPidEnv, os.Getpid()),
+	)
+	if err := cmd.Start(); err != nil {
+		atomic.StoreInt32(&upgrading, 0)
+		return err
+	}
+	zap.L().Info("Started upgraded process",
+		zap.String("path", exe),
+		zap.Int("pid", cmd.Process.Pid),
+		zap.Int("listeners", len(files)),
+	)
+
+	go func() {
+		// only returns before we're stopped if the new process failed
+		err := cmd.Wait()
+		zap.L().Error("Upgraded process exited", zap.Error(err))
+		atomic.StoreInt32(&upgrading, 0)
+	}()
+	return nil
+}
+
+// upgraded returns whether an upgraded process is running, it's the one
+// that stops this process once it took over the listeners
+func upgraded() bool {
+	return atomic.LoadInt32(&upgrading) == 1
+}
+
+// notifyParent tells the process that started this one for an upgrade to
+// stop and drain
+func notifyParent() {
+	pid, err := strconv.Atoi(os.Getenv(parentPidEnv))
+	os.Unsetenv(parentPidEnv)
+	if err != nil || pid != os.Getppid() {
+		return
+	}
+
+	p, err := os.FindProcess(pid)
+	if err == nil {
+		err = p.Signal(syscall.SIGTERM)
+	}
+	if err != nil {
+		zap.L().Error("Failed to stop the previous process", zap.Int("pid", pid), zap.Error(err))
+		return
+	}
+	zap.L().Info("Stopping the previous process", zap.Int("pid", pid))
+}